@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// apiToken is the JSON representation of a token in the /api routes.
+type apiToken struct {
+	ID           int       `json:"id"`
+	Token        string    `json:"token"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description"`
+	Interval     int       `json:"interval"`
+	Disabled     bool      `json:"disabled"`
+	Fired        bool      `json:"fired"`
+	State        string    `json:"state"`
+	Tags         []string  `json:"tags"`
+	Mode         string    `json:"mode"`
+	Count        int       `json:"count,omitempty"`
+	MinValue     *float64  `json:"min_value,omitempty"`
+	MaxDeviation float64   `json:"max_deviation,omitempty"`
+	DependsOn    int       `json:"depends_on,omitempty"`
+	Blocked      bool      `json:"blocked"`
+	TimeCreated  time.Time `json:"time_created"`
+}
+
+// apiNewToken is the body of POST /api/tokens.
+type apiNewToken struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Interval     int      `json:"interval"`
+	Tags         []string `json:"tags"`
+	Mode         string   `json:"mode"`
+	Count        int      `json:"count"`
+	MinValue     *float64 `json:"min_value"`
+	MaxDeviation float64  `json:"max_deviation"`
+	DependsOn    int      `json:"depends_on"`
+}
+
+func newAPIToken(t *Token) apiToken {
+	tags := t.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return apiToken{
+		ID:           t.ID,
+		Token:        t.Token,
+		Name:         t.Name,
+		Description:  t.Description,
+		Interval:     t.Interval,
+		Disabled:     t.Disabled,
+		Fired:        t.Fired,
+		State:        t.State(),
+		Tags:         tags,
+		Mode:         t.Rule.Mode,
+		Count:        t.Rule.Count,
+		MinValue:     t.Rule.MinValue,
+		MaxDeviation: t.Rule.MaxDeviation,
+		DependsOn:    t.DependsOn,
+		Blocked:      t.Blocked,
+		TimeCreated:  t.TimeCreated,
+	}
+}
+
+func (s *Server) addAPIRoutes() {
+	m := s.authMiddleware
+	s.mux.Method("get", "/api/tokens", m(http.HandlerFunc(s.apiListTokens)))
+	s.mux.Method("post", "/api/tokens", m(http.HandlerFunc(s.apiCreateToken)))
+	s.mux.Method("get", "/api/tokens/{id}", m(http.HandlerFunc(s.apiGetToken)))
+	s.mux.Method("delete", "/api/tokens/{id}", m(http.HandlerFunc(s.apiDeleteToken)))
+	s.mux.Method("post", "/api/tokens/{id}/{action:enable|disable}", m(http.HandlerFunc(s.apiUpdateDisable)))
+}
+
+func (s *Server) apiListTokens(w http.ResponseWriter, r *http.Request) {
+	list, err := s.model.GetTokens()
+	if err != nil {
+		s.internalError(w, "getting tokens", err)
+		return
+	}
+
+	tokens := []apiToken{}
+	for _, t := range filterFromQuery(r.URL.Query()).Apply(list) {
+		tokens = append(tokens, newAPIToken(t))
+	}
+	s.writeJSON(w, http.StatusOK, tokens)
+}
+
+func (s *Server) apiCreateToken(w http.ResponseWriter, r *http.Request) {
+	var in apiNewToken
+	err := json.NewDecoder(io.LimitReader(r.Body, maxImportSize)).Decode(&in)
+	if err != nil {
+		s.badRequestError(w, "parsing token: "+err.Error(), err)
+		return
+	}
+	f := tokenForm{
+		Name:        strings.TrimSpace(in.Name),
+		Description: strings.TrimSpace(in.Description),
+		Interval:    in.Interval,
+		Tags:        in.Tags,
+		Rule: Rule{
+			Mode:         in.Mode,
+			Count:        in.Count,
+			MinValue:     in.MinValue,
+			MaxDeviation: in.MaxDeviation,
+		}.withDefaults(),
+		DependsOn: in.DependsOn,
+	}
+	f.Tags = parseTags(strings.Join(f.Tags, ","))
+	err = f.validate()
+	if err != nil {
+		s.badRequestError(w, err.Error(), err)
+		return
+	}
+	list, err := s.model.GetTokens()
+	if err != nil {
+		s.internalError(w, "getting tokens", err)
+		return
+	}
+	err = checkDependency(list, 0, f.DependsOn)
+	if err != nil {
+		s.badRequestError(w, err.Error(), err)
+		return
+	}
+
+	token, err := s.model.CreateToken(f.Name, f.Description, f.Interval)
+	if err != nil {
+		s.internalError(w, "creating new token", err)
+		return
+	}
+	id, err := s.model.GetIdFromToken(token)
+	if err != nil {
+		s.internalError(w, "looking up new token", err)
+		return
+	}
+	err = s.model.UpdateToken(id, f.update())
+	if err != nil {
+		s.internalError(w, "setting token fields", err)
+		return
+	}
+
+	s.writeAPIToken(w, http.StatusCreated, id)
+}
+
+func (s *Server) apiGetToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
+		return
+	}
+	s.writeJSON(w, http.StatusOK, newAPIToken(t))
+}
+
+func (s *Server) apiDeleteToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := s.model.Remove(t.ID)
+	if err != nil {
+		s.internalError(w, "deleting token", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiUpdateDisable(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
+		return
+	}
+	err := s.model.Disable(t.ID, chi.URLParam(r, "action") == "disable")
+	if err != nil {
+		s.internalError(w, "disabling token", err)
+		return
+	}
+	s.writeAPIToken(w, http.StatusOK, t.ID)
+}
+
+func (s *Server) writeAPIToken(w http.ResponseWriter, code int, id int) {
+	t, err := s.model.GetToken(id)
+	if err != nil {
+		s.internalError(w, "loading token", err)
+		return
+	}
+	if t == nil {
+		http.Error(w, "error token not found", http.StatusNotFound)
+		return
+	}
+	s.writeJSON(w, code, newAPIToken(t))
+}
+
+// apiTokenPath is the path of a token in the API.
+func apiTokenPath(id int) string {
+	return "/api/tokens/" + strconv.Itoa(id)
+}
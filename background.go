@@ -11,6 +11,9 @@ type bgJobOpts struct {
 
 // Loop over the tokens and check the last heartbeat. Set the fire accordingly
 // Otherwise, loop and run the sleep fun
+//
+// Tokens whose dependency is fired are blocked instead, and not fired until
+// the dependency clears.
 func (s *Server) runBackgroundJob(opts bgJobOpts) {
 	logic := func() {
 		listTokens, err := s.model.GetTokens()
@@ -19,33 +22,51 @@ func (s *Server) runBackgroundJob(opts bgJobOpts) {
 			return
 		}
 
+		// The fire state of every enabled token, once evaluated
+		fired := map[int]bool{}
 		for _, t := range listTokens {
 			if t.Disabled {
 				continue
 			}
 
-			lastHB, err := s.model.LastHeartBeat(t.ID)
+			hbInValidRange, err := s.evaluate(t, time.Now())
 			if err != nil {
-				s.logger.Printf("runBackgroundJob: error getting last heartbeat: %s", err)
+				s.logger.Printf("runBackgroundJob: token id:%d: %s", t.ID, err)
 				return
 			}
+			fired[t.ID] = !hbInValidRange
+		}
 
-			secsSincelastHB := time.Now().Unix() - lastHB.Unix()
-			hbInValidRange := secsSincelastHB <= int64(t.Interval)
+		for _, t := range listTokens {
+			if t.Disabled {
+				continue
+			}
+
+			blocked := t.DependsOn != 0 && fired[t.DependsOn]
+			if blocked != t.Blocked {
+				if blocked {
+					s.logger.Printf("runBackgroundJob: blocking token id:%d, token id:%d is fired", t.ID, t.DependsOn)
+				} else {
+					s.logger.Printf("runBackgroundJob: unblocking token id:%d", t.ID)
+				}
+				err = s.model.Block(t.ID, blocked)
+				if err != nil {
+					s.logger.Printf("runBackgroundJob: error setting blocked for tokenID=%d err=%s", t.ID, err)
+					return
+				}
+			}
 
-			if t.Fired && !hbInValidRange {
+			fireValue := fired[t.ID] && !blocked
+			if t.Fired == fireValue {
 				continue
 			}
 
-			var fireValue bool
-			if t.Fired && hbInValidRange {
+			if !fireValue && !blocked {
 				s.logger.Printf("runBackgroundJob: clearing for token id:%d", t.ID)
-				fireValue = false
 			}
 
-			if !t.Fired && !hbInValidRange {
+			if fireValue {
 				s.logger.Printf("runBackgroundJob: firing for token id:%d", t.ID)
-				fireValue = true
 			}
 
 			err = s.model.Fire(t.ID, fireValue)
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backuper is implemented by models that can write a consistent snapshot of
+// their data.
+type Backuper interface {
+	Backup(w io.Writer) error
+}
+
+var errBackupUnsupported = errors.New("backups are only supported for SQLite; use pg_dump for postgres")
+
+// backuperFor returns the Backuper of a model, if it can back itself up.
+func backuperFor(m Model) (Backuper, bool) {
+	if sm, ok := m.(*SQLModel); ok && sm.db.d != sqliteDialect {
+		return nil, false
+	}
+	b, ok := m.(Backuper)
+	return b, ok
+}
+
+// Backup writes a consistent copy of the SQLite database to w.
+func (m *SQLModel) Backup(w io.Writer) error {
+	return backupSQLite(m.db, w)
+}
+
+// backupSQLite uses VACUUM INTO, which is safe to run while kae is serving
+// requests, to snapshot the database into a temporary file and then copies
+// it to w.
+func backupSQLite(db sqlDB, w io.Writer) error {
+	if db.d != sqliteDialect {
+		return errBackupUnsupported
+	}
+
+	dir, err := os.MkdirTemp("", "kae-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kae.sqlite")
+	_, err = db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// writeBackup writes a snapshot from b to w, gzip compressed if asked to.
+func writeBackup(b Backuper, w io.Writer, compress bool) error {
+	if !compress {
+		return b.Backup(w)
+	}
+	zw := gzip.NewWriter(w)
+	err := b.Backup(zw)
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeBackupFile writes a snapshot to path. The file only shows up once it is
+// complete.
+func writeBackupFile(b Backuper, path string, compress bool) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	err = writeBackup(b, f, compress)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreSQLite replaces the SQLite database at dbPath with the backup read
+// from r, which may be gzip compressed. The backup is checked before the
+// database is replaced. kae must not be running while restoring.
+func restoreSQLite(r io.Reader, dbPath string) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	var src io.Reader = br
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	tmp := dbPath + ".restore"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = checkSQLiteBackup(tmp)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+
+	// Leftovers from the old database would be replayed on top of the new one.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		err = os.Remove(dbPath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(tmp, dbPath)
+}
+
+// checkSQLiteBackup makes sure path is a healthy kae database.
+func checkSQLiteBackup(path string) error {
+	db, err := openSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'tokens'").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("no tokens table")
+	}
+	return nil
+}
+
+type scheduledBackupOpts struct {
+	dir      string
+	every    time.Duration
+	keep     int
+	compress bool
+	logger   Logger
+}
+
+// backupFilePrefix is used to recognize our files when rotating backups.
+const backupFilePrefix = "kae-"
+
+// runScheduledBackups writes a backup to opts.dir every opts.every, keeping
+// the most recent opts.keep files. It never returns.
+func runScheduledBackups(b Backuper, opts scheduledBackupOpts) {
+	for {
+		time.Sleep(opts.every)
+
+		err := scheduledBackup(b, opts, time.Now())
+		if err != nil {
+			opts.logger.Printf("scheduledBackup: %s", err)
+		}
+	}
+}
+
+func scheduledBackup(b Backuper, opts scheduledBackupOpts, now time.Time) error {
+	name := backupFilePrefix + now.UTC().Format("20060102-150405") + ".sqlite"
+	if opts.compress {
+		name += ".gz"
+	}
+	path := filepath.Join(opts.dir, name)
+	err := writeBackupFile(b, path, opts.compress)
+	if err != nil {
+		return err
+	}
+	opts.logger.Printf("scheduledBackup: wrote %s", path)
+
+	return rotateBackups(opts.dir, opts.keep)
+}
+
+// rotateBackups removes all but the keep most recent backups in dir.
+func rotateBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Names embed the time so sorting them sorts by age.
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, backupFilePrefix) && !strings.HasSuffix(name, ".tmp") {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for i := keep; i < len(names); i++ {
+		err = os.Remove(filepath.Join(dir, names[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultServerURL = "http://localhost:3500"
+
+// apiClient talks to the /api routes of a running kae server.
+type apiClient struct {
+	baseURL string
+	user    string
+	pass    string
+	http    *http.Client
+}
+
+func newAPIClientFromEnv(serverURL string) *apiClient {
+	if serverURL == "" {
+		serverURL = os.Getenv("KAE_URL")
+	}
+	if serverURL == "" {
+		serverURL = defaultServerURL
+	}
+	return &apiClient{
+		baseURL: strings.TrimSuffix(serverURL, "/"),
+		user:    os.Getenv("KAE_USER"),
+		pass:    os.Getenv("KAE_PASS"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends in as JSON, if not nil, and decodes the response into out, if not
+// nil.
+func (c *apiClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func tokenCmd(args []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `Usage: kae token list [-json] [-tag tag] [-state fired|blocked|ok|disabled]
+       kae token show [-json] id
+       kae token create [-json] -name name -description desc -interval secs [-tags a,b] [-mode mode [-count n]]
+                        [-min-value v] [-max-deviation pct] [-depends-on id]
+       kae token enable|disable|delete id
+
+Manage the tokens of a running kae server. The server is taken from -url or
+KAE_URL (default %q) and basic auth credentials from KAE_USER and KAE_PASS.
+`, defaultServerURL)
+	}
+	if len(args) == 0 {
+		usage()
+		return errors.New("token: missing subcommand")
+	}
+
+	action := args[0]
+	fs := flag.NewFlagSet("token "+action, flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(fs.Output(), "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	serverURL := fs.String("url", "", "kae server URL")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	var tag, state, name, desc, tags, mode *string
+	var interval, count, dependsOn *int
+	var maxDeviation *float64
+	// minValue stays nil unless -min-value is given
+	var minValue *float64
+	switch action {
+	case "list":
+		tag = fs.String("tag", "", "only tokens with this tag")
+		state = fs.String("state", "", "only tokens in this state: fired, blocked, ok or disabled")
+	case "create":
+		name = fs.String("name", "", "token name")
+		desc = fs.String("description", "", "token description")
+		interval = fs.Int("interval", 0, "expected number of seconds between heartbeats")
+		tags = fs.String("tags", "", "comma separated tags")
+		mode = fs.String("mode", ModeHeartbeat,
+			"heartbeat, inverse to fire when a heartbeat arrives, or min_count and max_count to expect at least or at most -count heartbeats per interval")
+		count = fs.Int("count", 0, "number of heartbeats per interval of the min_count and max_count modes")
+		fs.Func("min-value", "fire when the value sent with a heartbeat is below this", func(s string) error {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return err
+			}
+			minValue = &v
+			return nil
+		})
+		maxDeviation = fs.Float64("max-deviation", 0,
+			"fire when the value sent with a heartbeat is more than this percentage away from the average")
+		dependsOn = fs.Int("depends-on", 0, "id of a token this one depends on: it is blocked instead of fired while that token is fired")
+	case "show", "enable", "disable", "delete":
+	default:
+		usage()
+		return fmt.Errorf("token: unknown subcommand %q", action)
+	}
+	exitOnError(fs.Parse(args[1:]))
+	c := newAPIClientFromEnv(*serverURL)
+
+	switch action {
+	case "list":
+		q := url.Values{}
+		if *tag != "" {
+			q.Set("tag", *tag)
+		}
+		if *state != "" {
+			q.Set("state", *state)
+		}
+		var tokens []apiToken
+		err := c.do("GET", "/api/tokens?"+q.Encode(), nil, &tokens)
+		if err != nil {
+			return err
+		}
+		return printTokens(os.Stdout, tokens, *asJSON)
+	case "create":
+		var t apiToken
+		err := c.do("POST", "/api/tokens", apiNewToken{
+			Name:         *name,
+			Description:  *desc,
+			Interval:     *interval,
+			Tags:         parseTags(*tags),
+			Mode:         *mode,
+			Count:        *count,
+			MinValue:     minValue,
+			MaxDeviation: *maxDeviation,
+			DependsOn:    *dependsOn,
+		}, &t)
+		if err != nil {
+			return err
+		}
+		return printTokens(os.Stdout, []apiToken{t}, *asJSON)
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("token %s: missing token id", action)
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("token %s: invalid token id %q", action, fs.Arg(0))
+	}
+
+	switch action {
+	case "show":
+		var t apiToken
+		err = c.do("GET", apiTokenPath(id), nil, &t)
+		if err != nil {
+			return err
+		}
+		return printTokens(os.Stdout, []apiToken{t}, *asJSON)
+	case "delete":
+		return c.do("DELETE", apiTokenPath(id), nil, nil)
+	default:
+		var t apiToken
+		err = c.do("POST", apiTokenPath(id)+"/"+action, nil, &t)
+		if err != nil {
+			return err
+		}
+		return printTokens(os.Stdout, []apiToken{t}, *asJSON)
+	}
+}
+
+func printTokens(w io.Writer, tokens []apiToken, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tokens)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATE\tINTERVAL\tTOKEN\tTAGS")
+	for _, t := range tokens {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%ds\t%s\t%s\n",
+			t.ID, t.Name, t.State, t.Interval, t.Token, strings.Join(t.Tags, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+func TestAPIClient(t *testing.T) {
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: middleware.BasicAuth("kae", map[string]string{"admin": "secret"}),
+	})
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	c := newAPIClientFromEnv(ts.URL + "/")
+	c.user, c.pass = "admin", "wrong"
+	err = c.do("GET", "/api/tokens", nil, &[]apiToken{})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected an unauthorized error, got %v", err)
+	}
+
+	c.pass = "secret"
+	var created apiToken
+	err = c.do("POST", "/api/tokens", apiNewToken{Name: "backup", Description: "db", Interval: 60}, &created)
+	ensureNoError(t, err)
+
+	err = c.do("POST", apiTokenPath(created.ID)+"/enable", nil, nil)
+	ensureNoError(t, err)
+
+	var tokens []apiToken
+	err = c.do("GET", "/api/tokens", nil, &tokens)
+	ensureNoError(t, err)
+	ensureInt(t, len(tokens), 1)
+
+	var out bytes.Buffer
+	ensureNoError(t, printTokens(&out, tokens, false))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	ensureInt(t, len(lines), 2)
+	if !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "fired") {
+		t.Fatalf("unexpected table:\n%s", out.String())
+	}
+
+	err = c.do("GET", apiTokenPath(created.ID+1), nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+// Package client sends heartbeats to a kae server.
+//
+// A cron job reports a run with Start and Finish, or just Ping when it is
+// done. Long running daemons use Tick to ping at a fixed interval:
+//
+//	c := client.New("https://kae.example.com")
+//	go c.Tick(ctx, token, time.Minute, nil)
+//
+// Requests that fail because of the network or a 5xx response are retried
+// with exponential backoff, and rate limited ones (429) once the server says
+// so in Retry-After. Unknown statuses and other 4xx responses are not.
+// With SpoolDir set, pings that still fail are saved to disk and sent, with
+// their original time, before the next ping goes out.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ping statuses understood by /hb/{token}.
+const (
+	StatusOK    = "ok"
+	StatusStart = "start"
+	StatusFail  = "fail"
+)
+
+// Client sends heartbeats to the kae server at URL. The zero values of the
+// other fields are replaced by sensible defaults in New.
+type Client struct {
+	URL string
+	// HTTPClient sends the requests. Its Timeout bounds each attempt.
+	HTTPClient *http.Client
+	// Retries is the number of times a failed ping is retried.
+	Retries int
+	// Backoff is the wait before the first retry. It doubles on each retry.
+	Backoff time.Duration
+	// SpoolDir, if set, is where pings that could not be delivered wait to
+	// be sent again.
+	SpoolDir string
+	// Host is sent with every ping so kae can tell apart hosts sharing a
+	// token. New sets it to the hostname.
+	Host string
+	// RunID, if set, is sent with every ping to tie a start to its finish.
+	RunID string
+
+	// spoolMu keeps concurrent pings from replaying the same spooled ping.
+	spoolMu sync.Mutex
+}
+
+// Result describes a finished run of a job.
+type Result struct {
+	ExitCode int
+	Duration time.Duration
+	// Output is sent along with the ping. kae only keeps its last 10KB.
+	Output string
+}
+
+// New returns a client for the kae server at url with 3 retries, a 1s
+// initial backoff and a 10s timeout per attempt.
+func New(url string) *Client {
+	host, _ := os.Hostname()
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retries:    3,
+		Backoff:    time.Second,
+		Host:       host,
+	}
+}
+
+// Ping sends a plain heartbeat.
+func (c *Client) Ping(ctx context.Context, token string) error {
+	return c.send(ctx, token, url.Values{"status": {StatusOK}}, "")
+}
+
+// Start tells kae a run of the job has started.
+func (c *Client) Start(ctx context.Context, token string) error {
+	return c.send(ctx, token, url.Values{"status": {StatusStart}}, "")
+}
+
+// Finish reports the end of a run. Runs with a non zero exit code fail.
+func (c *Client) Finish(ctx context.Context, token string, r Result) error {
+	status := StatusOK
+	if r.ExitCode != 0 {
+		status = StatusFail
+	}
+	q := url.Values{
+		"status":    {status},
+		"exit_code": {strconv.Itoa(r.ExitCode)},
+	}
+	if r.Duration > 0 {
+		q.Set("duration", strconv.FormatFloat(r.Duration.Seconds(), 'f', 3, 64))
+	}
+	return c.send(ctx, token, q, r.Output)
+}
+
+// Tick pings every interval until ctx is done, starting right away. Errors
+// are passed to onError, which may be nil, and do not stop the ticker.
+func (c *Client) Tick(ctx context.Context, token string, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := c.Ping(ctx, token)
+		if err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// errPermanent wraps errors that retrying will not fix.
+type errPermanent struct{ error }
+
+func (e errPermanent) Unwrap() error { return e.error }
+
+// errRateLimited is a 429 response. The ping can be sent again after wait, if
+// the server said how long.
+type errRateLimited struct {
+	error
+	wait time.Duration
+}
+
+func (e errRateLimited) Unwrap() error { return e.error }
+
+// send hits /hb/{token} with the time of the ping in ts, so it can be spooled
+// and sent later. Spooled pings go first.
+func (c *Client) send(ctx context.Context, token string, q url.Values, output string) error {
+	if token == "" {
+		return errors.New("kae client: empty token")
+	}
+	q.Set("ts", formatTS(time.Now()))
+	if c.Host != "" {
+		q.Set("host", c.Host)
+	}
+	if c.RunID != "" {
+		q.Set("run_id", c.RunID)
+	}
+	p := spooledPing{Token: token, Query: q.Encode(), Output: output}
+	if c.SpoolDir == "" {
+		return c.sendWithRetries(ctx, p)
+	}
+
+	c.spoolMu.Lock()
+	defer c.spoolMu.Unlock()
+	err := c.replay(ctx)
+	if err == nil {
+		err = c.sendWithRetries(ctx, p)
+	}
+	if err != nil && !errors.As(err, new(errPermanent)) {
+		if spoolErr := c.spool(p); spoolErr != nil {
+			return fmt.Errorf("%w (spooling it failed: %s)", err, spoolErr)
+		}
+		return fmt.Errorf("%w: %s", ErrSpooled, err)
+	}
+	return err
+}
+
+// sendWithRetries sends a ping, retrying on failure. The output, if any, is
+// sent as the body of a POST.
+func (c *Client) sendWithRetries(ctx context.Context, p spooledPing) error {
+	u := c.URL + "/hb/" + url.PathEscape(p.Token) + "?" + p.Query
+	output := p.Output
+
+	wait := c.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = c.do(ctx, u, output)
+		if err == nil || attempt >= c.Retries || errors.As(err, new(errPermanent)) {
+			break
+		}
+		delay := wait
+		var limited errRateLimited
+		if errors.As(err, &limited) && limited.wait > delay {
+			delay = limited.wait
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		wait *= 2
+	}
+	if err != nil {
+		q, _ := url.ParseQuery(p.Query)
+		return fmt.Errorf("kae client: ping %s: %w", q.Get("status"), err)
+	}
+	return nil
+}
+
+func formatTS(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+}
+
+func (c *Client) do(ctx context.Context, u, output string) error {
+	method := http.MethodGet
+	var body io.Reader
+	if output != "" {
+		method = http.MethodPost
+		body = strings.NewReader(output)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return errPermanent{err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return errRateLimited{err, retryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	if resp.StatusCode < 500 {
+		return errPermanent{err}
+	}
+	return err
+}
+
+// retryAfter parses a Retry-After header, in seconds or as a date, into how
+// long to wait from now. It returns 0 if the header is missing or invalid.
+func retryAfter(h string, now time.Time) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
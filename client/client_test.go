@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a fake kae server that fails the first failures requests with
+// code, and retryAfter as the Retry-After header if set.
+type recorder struct {
+	mu         sync.Mutex
+	failures   int
+	code       int
+	retryAfter string
+	requests   []*http.Request
+	bodies     []string
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, string(body))
+	if rec.failures > 0 {
+		rec.failures--
+		if rec.retryAfter != "" {
+			w.Header().Set("Retry-After", rec.retryAfter)
+		}
+		http.Error(w, "error", rec.code)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (rec *recorder) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.requests)
+}
+
+func newTestClient(t *testing.T, rec *recorder) *Client {
+	t.Helper()
+	ts := httptest.NewServer(rec)
+	t.Cleanup(ts.Close)
+	c := New(ts.URL + "/")
+	c.HTTPClient = ts.Client()
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestRetries(t *testing.T) {
+	rec := &recorder{failures: 2, code: http.StatusBadGateway}
+	c := newTestClient(t, rec)
+	err := c.Ping(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if rec.count() != 3 {
+		t.Fatalf("got %d requests, want 3", rec.count())
+	}
+	if got := rec.requests[2].URL; got.Path != "/hb/abc" || got.Query().Get("status") != StatusOK {
+		t.Fatalf("got request %q", got)
+	}
+
+	// Out of retries
+	rec = &recorder{failures: 10, code: http.StatusServiceUnavailable}
+	c = newTestClient(t, rec)
+	c.Retries = 1
+	err = c.Ping(context.Background(), "abc")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got err %v, want a 503", err)
+	}
+	if rec.count() != 2 {
+		t.Fatalf("got %d requests, want 2", rec.count())
+	}
+
+	// Rate limited pings are retried once the server says so, and spooled
+	// when out of retries
+	rec = &recorder{failures: 1, code: http.StatusTooManyRequests, retryAfter: "1"}
+	c = newTestClient(t, rec)
+	start := time.Now()
+	err = c.Ping(context.Background(), "abc")
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if rec.count() != 2 {
+		t.Fatalf("got %d requests, want 2", rec.count())
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("retried after %s, want Retry-After to be honored", waited)
+	}
+	rec = &recorder{failures: 10, code: http.StatusTooManyRequests}
+	c = newTestClient(t, rec)
+	c.Retries = 1
+	c.SpoolDir = t.TempDir()
+	err = c.Ping(context.Background(), "abc")
+	if !errors.Is(err, ErrSpooled) {
+		t.Fatalf("got err %v, want %v", err, ErrSpooled)
+	}
+	if rec.count() != 2 {
+		t.Fatalf("got %d requests, want 2", rec.count())
+	}
+
+	// Client errors are not retried
+	rec = &recorder{failures: 10, code: http.StatusBadRequest}
+	c = newTestClient(t, rec)
+	err = c.Ping(context.Background(), "abc")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if rec.count() != 1 {
+		t.Fatalf("got %d requests, want 1", rec.count())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Duration{
+		"20":                            20 * time.Second,
+		"Fri, 01 Mar 2024 12:00:30 GMT": 30 * time.Second,
+		"Fri, 01 Mar 2024 11:00:00 GMT": 0,
+		"-1":                            0,
+		"":                              0,
+	} {
+		if got := retryAfter(h, now); got != want {
+			t.Errorf("retryAfter(%q) = %s, want %s", h, got, want)
+		}
+	}
+}
+
+func TestStartFinish(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec)
+	c.Host, c.RunID = "db1", "run-1"
+	ctx := context.Background()
+
+	if err := c.Start(ctx, "abc"); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	err := c.Finish(ctx, "abc", Result{ExitCode: 2, Duration: 1500 * time.Millisecond, Output: "boom\n"})
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+
+	if got := rec.requests[0].URL.Query().Get("status"); got != StatusStart {
+		t.Fatalf("got status %q, want %q", got, StatusStart)
+	}
+	finish := rec.requests[1]
+	if finish.Method != http.MethodPost {
+		t.Fatalf("got method %s, want POST", finish.Method)
+	}
+	q := finish.URL.Query()
+	for k, want := range map[string]string{
+		"status": StatusFail, "exit_code": "2", "duration": "1.500", "host": "db1", "run_id": "run-1",
+	} {
+		if q.Get(k) != want {
+			t.Fatalf("got %s=%q, want %q", k, q.Get(k), want)
+		}
+	}
+	if rec.bodies[1] != "boom\n" {
+		t.Fatalf("got body %q", rec.bodies[1])
+	}
+}
+
+func TestTick(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Tick(ctx, "abc", time.Millisecond, func(err error) { t.Errorf("tick: %v", err) })
+		close(done)
+	}()
+	for rec.count() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Tick did not return after cancel")
+	}
+}
+
+func TestSpool(t *testing.T) {
+	rec := &recorder{failures: 1, code: http.StatusBadGateway}
+	c := newTestClient(t, rec)
+	c.Retries = 0
+	c.SpoolDir = t.TempDir()
+	ctx := context.Background()
+
+	err := c.Finish(ctx, "abc", Result{Output: "done\n"})
+	if !errors.Is(err, ErrSpooled) {
+		t.Fatalf("got err %v, want %v", err, ErrSpooled)
+	}
+	spooledTS := rec.requests[0].URL.Query().Get("ts")
+	time.Sleep(10 * time.Millisecond)
+
+	// The spooled ping goes out, with its original time, before the next one
+	err = c.Ping(ctx, "xyz")
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if rec.count() != 3 {
+		t.Fatalf("got %d requests, want 3", rec.count())
+	}
+	replayed := rec.requests[1]
+	if replayed.URL.Path != "/hb/abc" || replayed.URL.Query().Get("ts") != spooledTS || rec.bodies[1] != "done\n" {
+		t.Fatalf("got replayed request %s with body %q", replayed.URL, rec.bodies[1])
+	}
+	if rec.requests[2].URL.Path != "/hb/xyz" || rec.requests[2].URL.Query().Get("ts") == spooledTS {
+		t.Fatalf("got request %s", rec.requests[2].URL)
+	}
+
+	entries, err := os.ReadDir(c.SpoolDir)
+	if err != nil {
+		t.Fatalf("reading spool: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %d spooled pings after replay, want 0", len(entries))
+	}
+
+	// Pings the server rejects are not spooled
+	rec.failures, rec.code = 2, http.StatusBadRequest
+	err = c.Ping(ctx, "abc")
+	if err == nil || errors.Is(err, ErrSpooled) {
+		t.Fatalf("got err %v, want a rejected ping", err)
+	}
+}
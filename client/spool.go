@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrSpooled is returned, wrapped, when a ping could not be delivered and was
+// saved in SpoolDir to be sent later.
+var ErrSpooled = errors.New("kae client: ping spooled")
+
+// spooledPing is a ping as saved in SpoolDir.
+type spooledPing struct {
+	Token  string `json:"token"`
+	Query  string `json:"query"`
+	Output string `json:"output,omitempty"`
+}
+
+const spoolExt = ".ping"
+
+// spool saves p in SpoolDir. File names start with the time so they sort in
+// the order the pings happened.
+func (c *Client) spool(p spooledPing) error {
+	err := os.MkdirAll(c.SpoolDir, 0o700)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write to a temporary name first so a crash never leaves half a ping.
+	tmp := filepath.Join(c.SpoolDir, name+".tmp")
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.SpoolDir, name+spoolExt))
+}
+
+// Replay sends the pings waiting in SpoolDir, oldest first. It stops at the
+// first one that cannot be delivered, which stays in the spool. Pings the
+// server rejects, for instance because they are too old, are dropped.
+func (c *Client) Replay(ctx context.Context) error {
+	c.spoolMu.Lock()
+	defer c.spoolMu.Unlock()
+	return c.replay(ctx)
+}
+
+func (c *Client) replay(ctx context.Context) error {
+	if c.SpoolDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(c.SpoolDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(c.SpoolDir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var p spooledPing
+		err = json.Unmarshal(data, &p)
+		if err == nil {
+			err = c.sendWithRetries(ctx, p)
+		} else {
+			err = errPermanent{err}
+		}
+		if err != nil && !errors.As(err, new(errPermanent)) {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
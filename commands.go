@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// commands maps subcommand names to their implementation. Running kae without
+// a subcommand starts the server.
+var commands = map[string]func(args []string) error{
+	"migrate": migrateCmd,
+	"backup":  backupCmd,
+	"restore": restoreCmd,
+	"export":  exportCmd,
+	"import":  importCmd,
+	"config":  configCmd,
+	"token":   tokenCmd,
+	"run":     runCmd,
+}
+
+// sqlitePathFromEnv returns the SQLite database of the config, failing if
+// kae is configured to use another store.
+func sqlitePathFromEnv() (string, error) {
+	cfg, err := configFromEnv()
+	if err != nil {
+		return "", err
+	}
+	if cfg.DBURL != "" {
+		return "", errBackupUnsupported
+	}
+	return cfg.DBPath, nil
+}
+
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list pending migrations without applying them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae migrate [-dry-run]
+
+Apply pending schema migrations to the postgres database in KAE_DB_URL or,
+if unset, the SQLite database in KAE_DB (default %q). Both can also be set
+in the config file named by KAE_CONFIG.
+
+Options:
+`, defaultDBPath)
+		fs.PrintDefaults()
+	}
+	exitOnError(fs.Parse(args))
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	if cfg.DBURL == memoryURL {
+		fmt.Println("the in-memory store has no schema to migrate")
+		return nil
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pending, err := migrate(db, *dryRun)
+	if err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		fmt.Printf("schema is up to date (version %d)\n", version)
+		return nil
+	}
+	verb := "applied"
+	if *dryRun {
+		verb = "pending"
+	}
+	for _, mig := range pending {
+		fmt.Printf("%s %d: %s\n", verb, mig.version, mig.name)
+	}
+	fmt.Printf("schema version %d\n", version)
+	return nil
+}
+
+func backupCmd(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	compress := fs.Bool("gzip", false, "gzip the backup")
+	out := fs.String("o", "-", "file to write the backup to, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae backup [-gzip] [-o file]
+
+Write a consistent snapshot of the SQLite database in KAE_DB (default %q).
+It is safe to run while kae is serving requests.
+
+Options:
+`, defaultDBPath)
+		fs.PrintDefaults()
+	}
+	exitOnError(fs.Parse(args))
+
+	dbPath, err := sqlitePathFromEnv()
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	b := &SQLModel{db: sqlDB{db, sqliteDialect}}
+
+	if *out == "-" {
+		return writeBackup(b, os.Stdout, *compress)
+	}
+	return writeBackupFile(b, *out, *compress)
+}
+
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite an existing database")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae restore [-force] file
+
+Replace the SQLite database in KAE_DB (default %q) with a backup written by
+kae backup, gzip compressed or not. Use - to read the backup from stdin.
+Stop kae before restoring.
+
+Options:
+`, defaultDBPath)
+		fs.PrintDefaults()
+	}
+	exitOnError(fs.Parse(args))
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("restore: missing backup file")
+	}
+
+	dbPath, err := sqlitePathFromEnv()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dbPath); err == nil && !*force {
+		return fmt.Errorf("restore: %s already exists, use -force to overwrite it", dbPath)
+	}
+
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	err = restoreSQLite(r, dbPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %s\n", dbPath)
+	return nil
+}
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "", "json or yaml (default from the -o extension, json otherwise)")
+	out := fs.String("o", "-", "file to write the tokens to, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae export [-format json|yaml] [-o file]
+
+Write the definition of every token, including its token string, so it can
+be loaded into another kae instance with kae import.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	exitOnError(fs.Parse(args))
+	if *format == "" {
+		*format = formatFromPath(*out)
+	}
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	model, _, err := openModel(cfg)
+	if err != nil {
+		return err
+	}
+	export, err := exportTokens(model)
+	if err != nil {
+		return err
+	}
+	data, err := marshalExport(export, *format)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0o600)
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "json or yaml (default from the file extension, json otherwise)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae import [-format json|yaml] file
+
+Create or update tokens from a file written by kae export. Tokens are
+matched by their token string, so importing the same file twice is a no-op.
+Use - to read from stdin.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	exitOnError(fs.Parse(args))
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import: missing file")
+	}
+	if *format == "" {
+		*format = formatFromPath(fs.Arg(0))
+	}
+
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	export, err := unmarshalExport(data, *format)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	model, _, err := openModel(cfg)
+	if err != nil {
+		return err
+	}
+	result, err := importTokens(model, export)
+	fmt.Printf("created=%d updated=%d unchanged=%d\n", result.Created, result.Updated, result.Unchanged)
+	return err
+}
+
+func configCmd(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintf(os.Stderr, "Usage: kae config print [options]\n")
+		return errors.New("config: unknown or missing subcommand")
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae config print [options]
+
+Print the effective server config, and where each value comes from, with
+secrets redacted. It takes the same options as the server.
+`)
+		defaultConfig().usage(fs.Output())
+	}
+	cfg, err := loadConfig(fs, args[1:], os.LookupEnv)
+	if cfg != nil {
+		if perr := cfg.Print(os.Stdout); perr != nil {
+			return perr
+		}
+	}
+	return err
+}
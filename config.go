@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the kae server. Values come from, in order of
+// precedence: command line flags, environment variables, the config file and
+// the defaults.
+type Config struct {
+	ConfigPath        string
+	Port              int
+	DBPath            string
+	DBURL             string
+	User              string
+	Pass              string
+	DelaySecs         int
+	RotateOverlapSecs int
+	MaxPingAgeSecs    int
+	OrphanStatus      int
+	TrustedProxies    string
+	HBTokenRate       int
+	HBIPRate          int
+	HBMinSpacingSecs  int
+	SMTPAddr          string
+	SMTPDomain        string
+	UDPAddr           string
+	TCPAddr           string
+	TokenLength       int
+	TokenAlphabet     string
+	BackupDir         string
+	BackupEverySecs   int
+	BackupKeep        int
+	Monitors          string
+
+	// sources records where each value came from, by config key.
+	sources map[string]string
+}
+
+// configField describes one setting and where it can be set. Secrets cannot
+// be passed as flags, where they would show up in ps.
+type configField struct {
+	key    string
+	flag   string
+	env    string
+	usage  string
+	secret bool
+	str    *string
+	num    *int
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:              3500,
+		DBPath:            defaultDBPath,
+		DelaySecs:         5,
+		RotateOverlapSecs: 24 * 60 * 60,
+		MaxPingAgeSecs:    24 * 60 * 60,
+		OrphanStatus:      200,
+		TrustedProxies:    "127.0.0.0/8,::1",
+		HBTokenRate:       60,
+		HBIPRate:          600,
+		HBMinSpacingSecs:  0,
+		SMTPDomain:        "kae.local",
+		TokenLength:       defaultTokenLength,
+		TokenAlphabet:     defaultTokenAlphabet,
+		BackupEverySecs:   60 * 60,
+		BackupKeep:        24,
+		sources:           map[string]string{},
+	}
+}
+
+func (c *Config) fields() []configField {
+	return []configField{
+		{key: "port", flag: "port", env: "PORT", usage: "HTTP port to listen on", num: &c.Port},
+		{key: "db", flag: "db", env: "KAE_DB", usage: "path to SQLite 3 database", str: &c.DBPath},
+		{key: "db_url", env: "KAE_DB_URL", secret: true, str: &c.DBURL,
+			usage: "postgres DSN (postgres://...) or memory:// for a throwaway in-memory store; takes precedence over db"},
+		{key: "user", env: "KAE_USER", usage: "basic auth username (default no basic auth)", str: &c.User},
+		{key: "pass", env: "KAE_PASS", secret: true, usage: "basic auth password (default no basic auth)", str: &c.Pass},
+		{key: "delay_secs", flag: "delaySecs", env: "KAE_DELAY_SECS", usage: "number of seconds between heartbeat updates", num: &c.DelaySecs},
+		{key: "rotate_overlap_secs", flag: "rotateOverlapSecs", env: "KAE_ROTATE_OVERLAP_SECS", num: &c.RotateOverlapSecs,
+			usage: "number of seconds an old token keeps working after a rotation"},
+		{key: "max_ping_age_secs", flag: "maxPingAgeSecs", env: "KAE_MAX_PING_AGE_SECS", num: &c.MaxPingAgeSecs,
+			usage: "how many seconds in the past a heartbeat may be backdated with ts, 0 to ignore ts"},
+		{key: "orphan_status", flag: "orphanStatus", env: "KAE_ORPHAN_STATUS", num: &c.OrphanStatus,
+			usage: "HTTP status code of heartbeats for unknown or deleted tokens, e.g. 404 to make curl -f fail"},
+		{key: "trusted_proxies", flag: "trustedProxies", env: "KAE_TRUSTED_PROXIES", str: &c.TrustedProxies,
+			usage: "comma separated IPs and CIDRs of proxies whose X-Forwarded-For is used as the heartbeat source"},
+		{key: "hb_token_rate", flag: "hbTokenRate", env: "KAE_HB_TOKEN_RATE", num: &c.HBTokenRate,
+			usage: "heartbeats per minute accepted for a token, 0 for no limit"},
+		{key: "hb_ip_rate", flag: "hbIPRate", env: "KAE_HB_IP_RATE", num: &c.HBIPRate,
+			usage: "heartbeats per minute accepted from a client address, 0 for no limit"},
+		{key: "hb_min_spacing_secs", flag: "hbMinSpacingSecs", env: "KAE_HB_MIN_SPACING_SECS", num: &c.HBMinSpacingSecs,
+			usage: "heartbeats repeating the status of the previous one sooner than this are not stored, 0 to store all"},
+		{key: "smtp_addr", flag: "smtpAddr", env: "KAE_SMTP_ADDR", str: &c.SMTPAddr,
+			usage: "address of an SMTP listener taking heartbeats by email, e.g. :2525 (default no SMTP listener)"},
+		{key: "smtp_domain", flag: "smtpDomain", env: "KAE_SMTP_DOMAIN", str: &c.SMTPDomain,
+			usage: "domain of the heartbeat email addresses, {token}@domain"},
+		{key: "udp_addr", flag: "udpAddr", env: "KAE_UDP_ADDR", str: &c.UDPAddr,
+			usage: "address of a UDP listener taking \"token[ status]\" heartbeats, e.g. :3501 (default none)"},
+		{key: "tcp_addr", flag: "tcpAddr", env: "KAE_TCP_ADDR", str: &c.TCPAddr,
+			usage: "address of a TCP listener taking \"token[ status]\" lines, e.g. :3501 (default none)"},
+		{key: "token_length", flag: "tokenLength", env: "KAE_TOKEN_LENGTH", usage: "number of characters of new tokens, at most 255 and enough for 64 bits of entropy", num: &c.TokenLength},
+		{key: "token_alphabet", flag: "tokenAlphabet", env: "KAE_TOKEN_ALPHABET", usage: "characters used to generate new tokens", str: &c.TokenAlphabet},
+		{key: "backup_dir", flag: "backupDir", env: "KAE_BACKUP_DIR", str: &c.BackupDir,
+			usage: "directory for scheduled, gzipped backups (default no scheduled backups)"},
+		{key: "backup_every_secs", flag: "backupEverySecs", env: "KAE_BACKUP_EVERY_SECS", usage: "number of seconds between scheduled backups", num: &c.BackupEverySecs},
+		{key: "backup_keep", flag: "backupKeep", env: "KAE_BACKUP_KEEP", usage: "number of scheduled backups to keep", num: &c.BackupKeep},
+		{key: "monitors", flag: "monitors", env: "KAE_MONITORS", usage: "YAML file of desired tokens, applied at startup and on SIGHUP", str: &c.Monitors},
+	}
+}
+
+// loadConfig builds the config from the defaults, the config file, the
+// environment and the flags in args. The config file is taken from -config or
+// KAE_CONFIG.
+func loadConfig(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := defaultConfig()
+	fields := c.fields()
+
+	// Flags are parsed as strings so they can be applied last.
+	configPath := fs.String("config", "", "YAML config file (env KAE_CONFIG)")
+	flagValues := map[string]*string{}
+	for _, f := range fields {
+		if f.flag != "" {
+			flagValues[f.flag] = fs.String(f.flag, "", f.usage)
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	c.ConfigPath = *configPath
+	if c.ConfigPath == "" {
+		c.ConfigPath, _ = lookupEnv("KAE_CONFIG")
+	}
+	if c.ConfigPath != "" {
+		values, err := readConfigFile(c.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			if v, ok := values[f.key]; ok {
+				errs = append(errs, c.set(f, v, "file "+c.ConfigPath))
+				delete(values, f.key)
+			}
+		}
+		for key := range values {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", c.ConfigPath, key))
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := lookupEnv(f.env); ok {
+			errs = append(errs, c.set(f, v, "env "+f.env))
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range fields {
+			if f.flag == fl.Name {
+				errs = append(errs, c.set(f, *flagValues[f.flag], "flag -"+f.flag))
+			}
+		}
+	})
+
+	errs = append(errs, c.validate()...)
+	return c, errors.Join(errs...)
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	err = yaml.NewDecoder(bytes.NewReader(data)).Decode(&values)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func (c *Config) set(f configField, value, source string) error {
+	if f.num != nil {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s (%s): %q is not a number", f.key, source, value)
+		}
+		*f.num = n
+	} else {
+		*f.str = value
+	}
+	c.sources[f.key] = source
+	return nil
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	if c.Port <= 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is not a valid port", c.Port))
+	}
+	if c.DBURL == "" && c.DBPath == "" {
+		errs = append(errs, errors.New("db: a database path is required"))
+	}
+	if c.DBURL != "" && c.DBURL != memoryURL &&
+		!strings.HasPrefix(c.DBURL, "postgres://") && !strings.HasPrefix(c.DBURL, "postgresql://") {
+		errs = append(errs, fmt.Errorf("db_url: unsupported scheme in %q, want postgres:// or %s", redactDSN(c.DBURL), memoryURL))
+	}
+	if c.User != "" && c.Pass == "" {
+		errs = append(errs, errors.New("user provided but missing pass"))
+	}
+	if c.User == "" && c.Pass != "" {
+		errs = append(errs, errors.New("pass provided but missing user"))
+	}
+	for _, f := range []struct {
+		key string
+		n   int
+	}{
+		{"delay_secs", c.DelaySecs},
+		{"backup_every_secs", c.BackupEverySecs},
+		{"backup_keep", c.BackupKeep},
+	} {
+		if f.n <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive, got %d", f.key, f.n))
+		}
+	}
+	for _, f := range []struct {
+		key string
+		n   int
+	}{
+		{"rotate_overlap_secs", c.RotateOverlapSecs},
+		{"max_ping_age_secs", c.MaxPingAgeSecs},
+		{"hb_token_rate", c.HBTokenRate},
+		{"hb_ip_rate", c.HBIPRate},
+		{"hb_min_spacing_secs", c.HBMinSpacingSecs},
+	} {
+		if f.n < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative, got %d", f.key, f.n))
+		}
+	}
+	if c.OrphanStatus < 200 || c.OrphanStatus > 599 {
+		errs = append(errs, fmt.Errorf("orphan_status: %d is not an HTTP status code", c.OrphanStatus))
+	}
+	if c.SMTPAddr != "" && c.SMTPDomain == "" {
+		errs = append(errs, errors.New("smtp_domain: required with smtp_addr"))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if err := c.tokenGenerator().validateLength(); err != nil {
+		errs = append(errs, fmt.Errorf("token_length: %w", err))
+	}
+	if err := c.tokenGenerator().validateAlphabet(); err != nil {
+		errs = append(errs, fmt.Errorf("token_alphabet: %w", err))
+	}
+	return errs
+}
+
+// configFromEnv loads the config for subcommands, which don't take the server
+// flags: only the file in KAE_CONFIG and the environment are used.
+func configFromEnv() (*Config, error) {
+	return loadConfig(flag.NewFlagSet("kae", flag.ContinueOnError), nil, os.LookupEnv)
+}
+
+func (c *Config) tokenGenerator() TokenGenerator {
+	return TokenGenerator{Length: c.TokenLength, Alphabet: c.TokenAlphabet}
+}
+
+// trustedProxies returns the parsed trusted_proxies, which loadConfig has
+// already validated.
+func (c *Config) trustedProxies() []*net.IPNet {
+	nets, _ := parseTrustedProxies(c.TrustedProxies)
+	return nets
+}
+
+// Print writes the effective config, with secrets redacted, in the config
+// file format along with where each value came from.
+func (c *Config) Print(w io.Writer) error {
+	for _, f := range c.fields() {
+		var value string
+		if f.num != nil {
+			value = strconv.Itoa(*f.num)
+		} else {
+			value = strconv.Quote(*f.str)
+		}
+		if f.secret && *f.str != "" {
+			value = strconv.Quote("REDACTED")
+			if f.key == "db_url" {
+				value = strconv.Quote(redactDSN(*f.str))
+			}
+		}
+		source := c.sources[f.key]
+		if source == "" {
+			source = "default"
+		}
+		_, err := fmt.Fprintf(w, "%s: %s # %s\n", f.key, value, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usage writes the options and environment variables of the server.
+func (c *Config) usage(w io.Writer) {
+	fmt.Fprintf(w, "\nOptions:\n  -%-18s %s\n", "config", "YAML config file with any of the settings below, by key")
+	for _, f := range c.fields() {
+		if f.flag != "" {
+			fmt.Fprintf(w, "  -%-18s %s%s\n", f.flag, f.usage, c.defaultNote(f))
+		}
+	}
+	fmt.Fprintf(w, "\nEnvironment variables:\n  %-24s %s\n", "KAE_CONFIG", "same as -config")
+	for _, f := range c.fields() {
+		fmt.Fprintf(w, "  %-24s %s%s\n", f.env, f.usage, c.defaultNote(f))
+	}
+	fmt.Fprintf(w, "\nConfig file keys: ")
+	var keys []string
+	for _, f := range c.fields() {
+		keys = append(keys, f.key)
+	}
+	fmt.Fprintf(w, "%s\n", strings.Join(keys, ", "))
+}
+
+func (c *Config) defaultNote(f configField) string {
+	switch {
+	case f.num != nil:
+		return fmt.Sprintf(" (default %d)", *f.num)
+	case *f.str != "":
+		return fmt.Sprintf(" (default %q)", *f.str)
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kae.yaml")
+	err := os.WriteFile(path, []byte("port: 4000\ndelay_secs: 10\ntoken_length: 32\n"), 0o600)
+	if err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	env := map[string]string{
+		"KAE_CONFIG":     path,
+		"KAE_DELAY_SECS": "20",
+		"KAE_USER":       "admin",
+		"KAE_PASS":       "hunter2",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	cfg, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-tokenLength", "40"}, lookupEnv)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	ensureInt(t, cfg.Port, 4000)      // file
+	ensureInt(t, cfg.DelaySecs, 20)   // env beats file
+	ensureInt(t, cfg.TokenLength, 40) // flag beats file
+	ensureInt(t, cfg.BackupKeep, 24)  // default
+	ensureString(t, cfg.User, "admin")
+
+	var out bytes.Buffer
+	ensureNoError(t, cfg.Print(&out))
+	printed := out.String()
+	if strings.Contains(printed, "hunter2") {
+		t.Fatalf("config print shows the password:\n%s", printed)
+	}
+	for _, line := range []string{
+		"port: 4000 # file " + path,
+		"delay_secs: 20 # env KAE_DELAY_SECS",
+		"token_length: 40 # flag -tokenLength",
+		"backup_keep: 24 # default",
+		`pass: "REDACTED" # env KAE_PASS`,
+	} {
+		if !strings.Contains(printed, line+"\n") {
+			t.Fatalf("config print misses %q:\n%s", line, printed)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	env := map[string]string{
+		"PORT":           "http",
+		"KAE_USER":       "admin",
+		"KAE_DB_URL":     "mysql://db",
+		"KAE_DELAY_SECS": "0",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	_, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"-tokenAlphabet", "a"}, lookupEnv)
+	if err == nil {
+		t.Fatalf("invalid config was accepted")
+	}
+	// Every problem is reported at once
+	for _, want := range []string{"port", "pass", "db_url", "delay_secs", "token_alphabet"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error does not mention %s:\n%v", want, err)
+		}
+	}
+
+	// Token strings must be long enough to be hard to guess, and fit the
+	// database
+	noEnv := func(string) (string, bool) { return "", false }
+	for _, args := range [][]string{
+		{"-tokenLength", "0"},
+		{"-tokenLength", "4", "-tokenAlphabet", "ab"},
+		{"-tokenLength", "256"},
+	} {
+		_, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, noEnv)
+		if err == nil || !strings.Contains(err.Error(), "token_length") || strings.Contains(err.Error(), "token_alphabet") {
+			t.Fatalf("got err %v for %v, want a token_length error", err, args)
+		}
+	}
+}
@@ -2,13 +2,32 @@ package main
 
 import (
 	"database/sql"
-	"math/rand"
+	"errors"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Number of times we try to generate a token string that is not in use.
+const maxTokenAttempts = 5
+
+var (
+	errTokenInUse  = errors.New("token string already in use")
+	errNoSuchToken = errors.New("no such token")
 )
 
+// SQLModel implements Model on top of SQLite or postgres.
 type SQLModel struct {
-	db  *sql.DB
-	rnd *rand.Rand
+	db     sqlDB
+	tokens TokenGenerator
+}
+
+// querier is implemented by both sqlDB and sqlTx.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 type ListTokens []*Token
@@ -22,55 +41,217 @@ type Token struct {
 	Disabled    bool
 	Fired       bool
 	TimeCreated time.Time
+	Tags        []string
+	Rule        Rule
+
+	// DependsOn is the id of the token this one depends on, 0 if none. While
+	// that token is fired this one is Blocked: it is not reported as fired.
+	DependsOn int
+	Blocked   bool
+}
+
+// TokenUpdate holds the user editable fields of a token, all stored at once by
+// UpdateToken.
+type TokenUpdate struct {
+	Name        string
+	Description string
+	Interval    int
+	Tags        []string
+	Rule        Rule
+	DependsOn   int
+}
+
+// update returns the user editable fields of the token as they are.
+func (t *Token) update() TokenUpdate {
+	return TokenUpdate{
+		Name:        t.Name,
+		Description: t.Description,
+		Interval:    t.Interval,
+		Tags:        t.Tags,
+		Rule:        t.Rule,
+		DependsOn:   t.DependsOn,
+	}
+}
+
+// State returns a short label for the token's current status: disabled,
+// blocked, fired or ok.
+func (t *Token) State() string {
+	switch {
+	case t.Disabled:
+		return "disabled"
+	case t.Blocked:
+		return "blocked"
+	case t.Fired:
+		return "fired"
+	default:
+		return "ok"
+	}
+}
+
+// Ping statuses. A plain heartbeat is ok. Jobs wrapped with kae run also
+// send a start ping before running and fail when they exit with an error.
+const (
+	PingOK    = "ok"
+	PingStart = "start"
+	PingFail  = "fail"
+)
+
+// Ping is a single heartbeat received for a token.
+type Ping struct {
+	Time     time.Time
+	Status   string
+	ExitCode *int
+	Duration time.Duration
+	// Output is the tail of the output of the job, if it sent one.
+	Output string
+
+	// Where the ping came from. Host and RunID are set by the client.
+	RemoteAddr string
+	UserAgent  string
+	Method     string
+	Host       string
+	RunID      string
+
+	// Value is a measurement sent with the ping, like the size of a backup,
+	// checked by the threshold rules of the token.
+	Value *float64
+	Unit  string
+}
+
+// ValueText is the value of the ping and its unit, if it sent one.
+func (p Ping) ValueText() string {
+	if p.Value == nil {
+		return ""
+	}
+	return strings.TrimSpace(formatValue(*p.Value) + " " + p.Unit)
+}
+
+// HeartBeat is a ping for a token, as stored by InsertHeartBeats.
+type HeartBeat struct {
+	TokenID int
+	Ping    Ping
+}
+
+// Number of orphan pings kept. Older ones are dropped as new ones come in.
+const maxOrphanPings = 1000
+
+// OrphanPing is a heartbeat for a token string that matches no live token:
+// a typo, or a job still pinging a deleted token.
+type OrphanPing struct {
+	Token      string
+	Time       time.Time
+	RemoteAddr string
+	UserAgent  string
+	// DeletedName is the name of the deleted token that used the token
+	// string, if any. It is filled in by GetOrphanPings.
+	DeletedName string
 }
 
+// NewSQLModel returns a model backed by a SQLite db, applying any pending
+// schema migrations first.
 func NewSQLModel(db *sql.DB) (*SQLModel, error) {
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	model := &SQLModel{db, rnd}
-	_, err := model.db.Exec(`
-		CREATE TABLE IF NOT EXISTS tokens (
-			id INTEGER NOT NULL PRIMARY KEY,
-			name VARCHAR(255) NOT NULL,
-			token VARCHAR(20) NOT NULL,
-      interval INTEGER,
-			description VARCHAR(1000) NOT NULL,
-
-      -- to disable the token temporarely
-      disabled BOOLEAN NOT NULL DEFAULT TRUE,
-      -- to indicate a token is in a fired state; will go back to false once we get a valid ping again
-      fired BOOLEAN NOT NULL DEFAULT TRUE,
-
-			time_created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		  time_deleted TIMESTAMP
-		);
-		
-		CREATE TABLE IF NOT EXISTS pings (
-			id INTEGER NOT NULL PRIMARY KEY,
-			token_id INTEGER NOT NULL REFERENCES tokens(id),
-			last_heartbeat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-		);
-		
-		CREATE INDEX IF NOT EXISTS tokens_list_id ON pings(token_id);
-		`)
+	return newSQLModel(sqlDB{db, sqliteDialect})
+}
+
+// NewPostgresModel is like NewSQLModel for a postgres db.
+func NewPostgresModel(db *sql.DB) (*SQLModel, error) {
+	return newSQLModel(sqlDB{db, postgresDialect})
+}
+
+func newSQLModel(db sqlDB) (*SQLModel, error) {
+	model := &SQLModel{db, defaultTokenGenerator}
+	_, err := migrate(db, false)
 	return model, err
 }
 
+// SetTokenGenerator changes how new token strings are generated.
+func (m *SQLModel) SetTokenGenerator(g TokenGenerator) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	m.tokens = g
+	return nil
+}
+
 // Create a token and return the id which identifies the token uniquely
 func (m *SQLModel) CreateToken(name, description string, interval int) (string, error) {
-	token := m.makeTokenID(20)
 	// Generate time here because SQLite's CURRENT_TIMESTAMP only returns seconds.
 	timeCreated := time.Now().In(time.UTC).Format(time.RFC3339Nano)
-	_, err := m.db.Exec(`INSERT INTO tokens 
+	return m.withNewTokenID(m.db, func(token string) error {
+		_, err := m.db.Exec(`INSERT INTO tokens 
     (token, name, interval, time_created, description) 
     VALUES (?, ?, ?, ?, ?)`,
-		token, name, interval, timeCreated, description)
-	return token, err
+			token, name, interval, timeCreated, description)
+		return err
+	})
+}
+
+// ImportToken stores a token keeping its token string, which is how tokens
+// are matched across instances. A token with the same token string is
+// updated, and brought back if it had been deleted. It returns the token id.
+func (m *SQLModel) ImportToken(t *Token) (int, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("SELECT id FROM tokens WHERE token = ?", t.Token).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		var n int
+		err = tx.QueryRow("SELECT COUNT(*) FROM token_secrets WHERE secret = ?", t.Token).Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return 0, errTokenInUse
+		}
+		timeCreated := time.Now().In(time.UTC).Format(time.RFC3339Nano)
+		err = tx.QueryRow(`INSERT INTO tokens
+      (token, name, interval, disabled, time_created, description)
+      VALUES (?, ?, ?, ?, ?, ?)
+      RETURNING id`,
+			t.Token, t.Name, t.Interval, t.Disabled, timeCreated, t.Description).Scan(&id)
+	case err == nil:
+		_, err = tx.Exec(`
+			UPDATE tokens
+			SET name = ?, description = ?, interval = ?, disabled = ?, time_deleted = NULL
+			WHERE id = ?
+		`, t.Name, t.Description, t.Interval, t.Disabled, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// tokenColumns are the columns scanned by scanToken.
+const tokenColumns = `id, token, name, interval, disabled, fired, time_created, description,
+    mode, ping_count, min_value, max_deviation, depends_on, blocked`
+
+func scanToken(row interface{ Scan(...interface{}) error }) (*Token, error) {
+	var t Token
+	var minValue sql.NullFloat64
+	var dependsOn sql.NullInt64
+	err := row.Scan(&t.ID, &t.Token, &t.Name, &t.Interval, &t.Disabled, &t.Fired, &t.TimeCreated, &t.Description,
+		&t.Rule.Mode, &t.Rule.Count, &minValue, &t.Rule.MaxDeviation, &dependsOn, &t.Blocked)
+	if err != nil {
+		return nil, err
+	}
+	if minValue.Valid {
+		t.Rule.MinValue = &minValue.Float64
+	}
+	t.DependsOn = int(dependsOn.Int64)
+	return &t, nil
 }
 
 // GetLists fetches all the tokens  ordered with the most recent first.
 func (m *SQLModel) GetTokens() (ListTokens, error) {
 	rows, err := m.db.Query(`
-		SELECT id, token, name, interval, disabled, fired, time_created, description
+		SELECT ` + tokenColumns + `
 		FROM tokens
     WHERE time_deleted is NULL
 		ORDER BY time_created DESC
@@ -81,41 +262,302 @@ func (m *SQLModel) GetTokens() (ListTokens, error) {
 	defer rows.Close()
 
 	var listTokens ListTokens
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		listTokens = append(listTokens, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = m.loadTags(listTokens)
+	return listTokens, err
+}
+
+// loadTags fills the Tags field of every token in the list.
+func (m *SQLModel) loadTags(listTokens ListTokens) error {
+	byID := map[int]*Token{}
+	for _, t := range listTokens {
+		byID[t.ID] = t
+	}
+
+	rows, err := m.db.Query(`
+    SELECT tt.token_id, tg.name
+    FROM token_tags as tt
+    JOIN tags as tg
+      ON tg.id = tt.tag_id
+    ORDER BY tg.name
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return err
+		}
+		if t, ok := byID[id]; ok {
+			t.Tags = append(t.Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// SetTags replaces the tags of a token. Unused tags are left in place.
+func (m *SQLModel) SetTags(id int, tags []string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = setTags(tx, id, tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setTags(tx sqlTx, id int, tags []string) error {
+	_, err := tx.Exec("DELETE FROM token_tags WHERE token_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range tags {
+		_, err = tx.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING", name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO token_tags (token_id, tag_id)
+			VALUES (?, (SELECT id FROM tags WHERE name = ?))
+			ON CONFLICT DO NOTHING`, id, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetToken fetches a single token. It returns nil if the token does not exist
+// or has been deleted.
+func (m *SQLModel) GetToken(id int) (*Token, error) {
+	t, err := scanToken(m.db.QueryRow(`
+		SELECT `+tokenColumns+`
+		FROM tokens
+    WHERE id = ? AND time_deleted is NULL
+		`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.loadTags(ListTokens{t})
+	return t, err
+}
+
+// UpdateToken changes the user editable fields of a token, all of them or
+// none if any is wrong. The token string and the pings are left untouched.
+// The dependency is checked in the same transaction, so that concurrent
+// updates cannot make a cycle.
+func (m *SQLModel) UpdateToken(id int, u TokenUpdate) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// SQLite transactions are serializable already; in postgres the rows are
+	// locked until the edit is committed.
+	query := "SELECT id, depends_on FROM tokens WHERE time_deleted is NULL ORDER BY id"
+	if tx.d == postgresDialect {
+		query += " FOR UPDATE"
+	}
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var list ListTokens
 	for rows.Next() {
 		var t Token
-		err = rows.Scan(&t.ID, &t.Token, &t.Name, &t.Interval, &t.Disabled, &t.Fired, &t.TimeCreated, &t.Description)
+		var dependsOn sql.NullInt64
+		err = rows.Scan(&t.ID, &dependsOn)
+		if err != nil {
+			return err
+		}
+		t.DependsOn = int(dependsOn.Int64)
+		list = append(list, &t)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	err = checkDependency(list, id, u.DependsOn)
+	if err != nil {
+		return err
+	}
+
+	var minValue sql.NullFloat64
+	if u.Rule.MinValue != nil {
+		minValue = sql.NullFloat64{Float64: *u.Rule.MinValue, Valid: true}
+	}
+	dep := sql.NullInt64{Int64: int64(u.DependsOn), Valid: u.DependsOn != 0}
+	res, err := tx.Exec(`
+			UPDATE tokens
+			SET name = ?, description = ?, interval = ?,
+			    mode = ?, ping_count = ?, min_value = ?, max_deviation = ?,
+			    depends_on = ?
+			WHERE id = ? AND time_deleted is NULL
+		`, u.Name, u.Description, u.Interval,
+		u.Rule.Mode, u.Rule.Count, minValue, u.Rule.MaxDeviation, dep, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoSuchToken
+	}
+
+	err = setTags(tx, id, u.Tags)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetRule changes how the pings of a token are evaluated.
+func (m *SQLModel) SetRule(id int, r Rule) error {
+	var minValue sql.NullFloat64
+	if r.MinValue != nil {
+		minValue = sql.NullFloat64{Float64: *r.MinValue, Valid: true}
+	}
+	_, err := m.db.Exec(`
+			UPDATE tokens
+			SET mode = ?, ping_count = ?, min_value = ?, max_deviation = ?
+			WHERE id = ?
+		`, r.Mode, r.Count, minValue, r.MaxDeviation, id)
+	return err
+}
+
+// pingColumns are the columns scanned by scanPing.
+const pingColumns = `last_heartbeat, status, exit_code, duration_ms, output,
+    remote_addr, user_agent, method, host, run_id, value, unit`
+
+func scanPing(row interface{ Scan(...interface{}) error }) (*Ping, error) {
+	var p Ping
+	var exitCode sql.NullInt64
+	var durationMs int64
+	var value sql.NullFloat64
+	err := row.Scan(&p.Time, &p.Status, &exitCode, &durationMs, &p.Output,
+		&p.RemoteAddr, &p.UserAgent, &p.Method, &p.Host, &p.RunID, &value, &p.Unit)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		p.ExitCode = &code
+	}
+	if value.Valid {
+		p.Value = &value.Float64
+	}
+	p.Duration = time.Duration(durationMs) * time.Millisecond
+	return &p, nil
+}
+
+// LastPing returns the most recent ping that ended a run, ok or fail. Start
+// pings are skipped. It returns nil if the token has none.
+func (m *SQLModel) LastPing(tokenId int) (*Ping, error) {
+	p, err := scanPing(m.db.QueryRow(`
+    SELECT `+pingColumns+`
+    FROM pings
+    WHERE token_id = ? AND status <> ?
+    ORDER BY last_heartbeat DESC, id DESC
+    LIMIT 1
+    `, tokenId, PingStart))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// GetPings returns up to limit pings of a token, start pings included, the
+// most recent first.
+func (m *SQLModel) GetPings(tokenId int, limit int) ([]Ping, error) {
+	rows, err := m.db.Query(`
+    SELECT `+pingColumns+`
+    FROM pings
+    WHERE token_id = ?
+    ORDER BY last_heartbeat DESC, id DESC
+    LIMIT ?
+    `, tokenId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pings []Ping
+	for rows.Next() {
+		p, err := scanPing(rows)
 		if err != nil {
 			return nil, err
 		}
-		listTokens = append(listTokens, &t)
+		pings = append(pings, *p)
 	}
-	return listTokens, rows.Err()
+	return pings, rows.Err()
 }
 
-// Number of seconds since last heartbeat
-func (m *SQLModel) LastHeartBeat(tokenId int) (time.Time, error) {
+// LastValues returns the values of the last n pings of a token that sent one,
+// the most recent first.
+func (m *SQLModel) LastValues(tokenId int, n int) ([]float64, error) {
 	rows, err := m.db.Query(`
-    SELECT p.last_heartbeat
-    FROM tokens as t
-    JOIN pings as p
-      ON t.id = p.token_id
-    WHERE t.id = ?
-    ORDER BY last_heartbeat
-    DESC limit 1
-    `, tokenId)
+    SELECT value
+    FROM pings
+    WHERE token_id = ? AND value IS NOT NULL
+    ORDER BY last_heartbeat DESC, id DESC
+    LIMIT ?
+    `, tokenId, n)
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
 	defer rows.Close()
 
-	var lastHB time.Time
+	var values []float64
 	for rows.Next() {
-		err = rows.Scan(&lastHB)
+		var v float64
+		err = rows.Scan(&v)
 		if err != nil {
-			return time.Time{}, err
+			return nil, err
 		}
+		values = append(values, v)
 	}
-	return lastHB, nil
+	return values, rows.Err()
+}
+
+// CountPings returns how many pings of a token, start pings excluded,
+// arrived at or after since.
+func (m *SQLModel) CountPings(tokenId int, since time.Time) (int, error) {
+	var n int
+	err := m.db.QueryRow(`
+    SELECT COUNT(*)
+    FROM pings
+    WHERE token_id = ? AND status <> ? AND last_heartbeat >= ?
+    `, tokenId, PingStart, m.db.d.ts(since)).Scan(&n)
+	return n, err
 }
 
 func (m *SQLModel) Fire(id int, b bool) error {
@@ -123,50 +565,261 @@ func (m *SQLModel) Fire(id int, b bool) error {
 	return err
 }
 
+// Block marks a token as blocked by the token it depends on.
+func (m *SQLModel) Block(id int, b bool) error {
+	_, err := m.db.Exec("UPDATE tokens SET blocked = ? WHERE id = ?", b, id)
+	return err
+}
+
 func (m *SQLModel) Disable(id int, b bool) error {
 	_, err := m.db.Exec("UPDATE tokens SET disabled = ? WHERE id = ?", b, id)
 	return err
 }
 
-func (m *SQLModel) InsertHeartBeat(id int) error {
-	_, err := m.db.Exec("INSERT INTO pings (token_id) VALUES (?)", id)
+func (m *SQLModel) InsertHeartBeat(id int, p Ping) error {
+	return insertPing(m.db.Exec, m.db.d, id, p)
+}
+
+// InsertHeartBeats stores several pings in a single transaction: either all
+// of them are stored or none is.
+func (m *SQLModel) InsertHeartBeats(hbs []HeartBeat) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, hb := range hbs {
+		err = insertPing(tx.Exec, tx.d, hb.TokenID, hb.Ping)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertPing(exec func(string, ...interface{}) (sql.Result, error), d dialect, id int, p Ping) error {
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	if p.Status == "" {
+		p.Status = PingOK
+	}
+	var exitCode sql.NullInt64
+	if p.ExitCode != nil {
+		exitCode = sql.NullInt64{Int64: int64(*p.ExitCode), Valid: true}
+	}
+	var value sql.NullFloat64
+	if p.Value != nil {
+		value = sql.NullFloat64{Float64: *p.Value, Valid: true}
+	}
+	_, err := exec(`INSERT INTO pings
+    (token_id, last_heartbeat, status, exit_code, duration_ms, output,
+     remote_addr, user_agent, method, host, run_id, value, unit)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, d.ts(p.Time), p.Status, exitCode, p.Duration.Milliseconds(), p.Output,
+		p.RemoteAddr, p.UserAgent, p.Method, p.Host, p.RunID, value, p.Unit)
 	return err
 }
 
+// Remove deletes a token. The tokens depending on it depend on none anymore.
 func (m *SQLModel) Remove(id int) error {
-	_, err := m.db.Exec(`
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
 			UPDATE tokens
 			SET time_deleted = CURRENT_TIMESTAMP
 			WHERE id = ?
 		`, id)
-	return err
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE tokens SET depends_on = NULL, blocked = ? WHERE depends_on = ?", false, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// GetIdFromToken returns the id of the live token that owns the token string.
+// Old token strings are accepted until their overlap period expires. It
+// returns 0 if no token matches or the token has been deleted.
 func (m *SQLModel) GetIdFromToken(token string) (int, error) {
-	rows, err := m.db.Query("select id from tokens WHERE token = ?", token)
+	var id int
+	err := m.db.QueryRow(`
+    SELECT id FROM tokens WHERE token = ? AND time_deleted is NULL
+    UNION ALL
+    SELECT s.token_id
+    FROM token_secrets as s
+    JOIN tokens as t
+      ON t.id = s.token_id
+    WHERE s.secret = ? AND s.time_expires > ? AND t.time_deleted is NULL
+    LIMIT 1
+    `, token, token, m.db.d.ts(time.Now())).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// InsertOrphanPing records a heartbeat for an unknown token string and drops
+// the oldest ones past maxOrphanPings.
+func (m *SQLModel) InsertOrphanPing(p OrphanPing) error {
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	_, err := m.db.Exec(`INSERT INTO orphan_pings
+    (token, time_received, remote_addr, user_agent)
+    VALUES (?, ?, ?, ?)`,
+		p.Token, m.db.d.ts(p.Time), p.RemoteAddr, p.UserAgent)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	_, err = m.db.Exec(`
+    DELETE FROM orphan_pings
+    WHERE id <= (SELECT MAX(id) FROM orphan_pings) - ?
+    `, maxOrphanPings)
+	return err
+}
+
+// GetOrphanPings returns up to limit orphan pings, the most recent first.
+func (m *SQLModel) GetOrphanPings(limit int) ([]OrphanPing, error) {
+	rows, err := m.db.Query(`
+    SELECT o.token, o.time_received, o.remote_addr, o.user_agent,
+           COALESCE((SELECT MAX(t.name) FROM tokens as t
+                     WHERE t.token = o.token AND t.time_deleted IS NOT NULL), '')
+    FROM orphan_pings as o
+    ORDER BY o.id DESC
+    LIMIT ?
+    `, limit)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
-	var id int
+	var list []OrphanPing
 	for rows.Next() {
-		err = rows.Scan(&id)
+		var p OrphanPing
+		err = rows.Scan(&p.Token, &p.Time, &p.RemoteAddr, &p.UserAgent, &p.DeletedName)
 		if err != nil {
-			return 0, err
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// RotateToken gives the token a new token string and returns it. The current
+// one keeps working for the overlap period.
+func (m *SQLModel) RotateToken(id int, overlap time.Duration) (string, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.QueryRow("SELECT token FROM tokens WHERE id = ? AND time_deleted is NULL", id).Scan(&old)
+	if err == sql.ErrNoRows {
+		return "", errNoSuchToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("DELETE FROM token_secrets WHERE time_expires <= ?", tx.d.ts(now))
+	if err != nil {
+		return "", err
+	}
+
+	if overlap > 0 {
+		_, err = tx.Exec(`INSERT INTO token_secrets
+      (token_id, secret, time_created, time_expires)
+      VALUES (?, ?, ?, ?)`,
+			id, old, tx.d.ts(now), tx.d.ts(now.Add(overlap)))
+		if err != nil {
+			return "", err
 		}
 	}
 
-	return id, nil
+	// A failed statement aborts the whole transaction in postgres, so every
+	// attempt runs in its own savepoint to be able to try again.
+	token, err := m.withNewTokenID(tx, func(token string) error {
+		_, err := tx.Exec("SAVEPOINT new_token")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE tokens SET token = ? WHERE id = ?", token, id)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT new_token"); rbErr != nil {
+				return rbErr
+			}
+			return err
+		}
+		_, err = tx.Exec("RELEASE SAVEPOINT new_token")
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
 }
 
-var listIDChars = "bcdfghjklmnpqrstvwxyz"
+// withNewTokenID generates token strings and calls fn with them until fn
+// stores one without colliding with a token string already in use, current
+// or rotated.
+func (m *SQLModel) withNewTokenID(q querier, fn func(token string) error) (string, error) {
+	for i := 0; i < maxTokenAttempts; i++ {
+		token, err := m.tokens.Generate()
+		if err != nil {
+			return "", err
+		}
 
-func (m *SQLModel) makeTokenID(n int) string {
-	id := make([]byte, n)
-	for i := 0; i < n; i++ {
-		index := m.rnd.Intn(len(listIDChars))
-		id[i] = listIDChars[index]
+		err = checkTokenNotInUse(q, token)
+		if err == nil {
+			err = fn(token)
+		}
+		if err == errTokenInUse || isUniqueViolation(err) {
+			continue
+		}
+		return token, err
+	}
+	return "", errTokenInUse
+}
+
+func checkTokenNotInUse(q querier, token string) error {
+	var n int
+	err := q.QueryRow(`
+    SELECT (SELECT COUNT(*) FROM tokens WHERE token = ?) +
+           (SELECT COUNT(*) FROM token_secrets WHERE secret = ?)
+    `, token, token).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errTokenInUse
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err comes from a unique constraint, in
+// SQLite or postgres.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE ||
+			code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
 	}
-	return string(id)
+	return false
 }
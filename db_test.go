@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTokenGenerator(t *testing.T) {
+	g := TokenGenerator{Length: 32, Alphabet: "abc123"}
+	if err := g.Validate(); err != nil {
+		t.Fatalf("validating generator: %v", err)
+	}
+	token, err := g.Generate()
+	if err != nil {
+		t.Fatalf("generating token: %v", err)
+	}
+	ensureInt(t, len(token), 32)
+	if strings.Trim(token, g.Alphabet) != "" {
+		t.Fatalf("token %q has characters outside of %q", token, g.Alphabet)
+	}
+
+	for _, bad := range []TokenGenerator{
+		{Length: 0, Alphabet: "abc"},
+		{Length: 20, Alphabet: "a"},
+		{Length: 20, Alphabet: "aab"},
+		{Length: 20, Alphabet: "ab/"},
+		{Length: 4, Alphabet: "ab"},
+		{Length: 256, Alphabet: "ab"},
+	} {
+		if bad.Validate() == nil {
+			t.Fatalf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestTokenCollisions(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	model, err := NewSQLModel(db)
+	if err != nil {
+		t.Fatalf("creating model: %v", err)
+	}
+
+	// Only two token strings are possible: one is in use by a token and the
+	// other is a rotated secret still within its overlap window. Such a
+	// generator is refused by SetTokenGenerator.
+	model.tokens = TokenGenerator{Length: 1, Alphabet: "ab"}
+	_, err = db.Exec(`INSERT INTO tokens (token, name, interval, description)
+    VALUES ('a', 'first', 1, 'first')`)
+	if err != nil {
+		t.Fatalf("inserting token: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO token_secrets (token_id, secret, time_expires)
+    VALUES (1, 'b', '9999-12-31 00:00:00')`)
+	if err != nil {
+		t.Fatalf("inserting secret: %v", err)
+	}
+
+	_, err = model.CreateToken("name", "desc", 10)
+	if err != errTokenInUse {
+		t.Fatalf("got err %v, want %v", err, errTokenInUse)
+	}
+
+	// The database refuses duplicates even if the check is bypassed
+	_, err = db.Exec(`INSERT INTO tokens (token, name, interval, description)
+    VALUES ('a', 'dup', 1, 'dup')`)
+	if !isUniqueViolation(err) {
+		t.Fatalf("got err %v, want a unique violation", err)
+	}
+	_, err = db.Exec(`INSERT INTO tokens (token, name, interval) VALUES ('c', NULL, 1)`)
+	if err == nil || isUniqueViolation(err) {
+		t.Fatalf("got err %v, want a violation of another constraint", err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Schema and data as created before migrations were versioned
+	_, err = db.Exec(`
+		CREATE TABLE tokens (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			token VARCHAR(20) NOT NULL,
+			interval INTEGER,
+			description VARCHAR(1000) NOT NULL,
+			disabled BOOLEAN NOT NULL DEFAULT TRUE,
+			fired BOOLEAN NOT NULL DEFAULT TRUE,
+			time_created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			time_deleted TIMESTAMP
+		);
+		CREATE TABLE pings (
+			id INTEGER NOT NULL PRIMARY KEY,
+			token_id INTEGER NOT NULL REFERENCES tokens(id),
+			last_heartbeat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO tokens (name, token, interval, description)
+		VALUES ('legacy', 'bcdfghjklmnpqrstvwxy', 60, 'created by an old kae');
+		`)
+	if err != nil {
+		t.Fatalf("creating legacy schema: %v", err)
+	}
+
+	sdb := sqlDB{db, sqliteDialect}
+	pending, err := migrate(sdb, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	ensureInt(t, len(pending), len(migrations))
+	version, err := schemaVersion(sdb)
+	if err != nil {
+		t.Fatalf("getting schema version: %v", err)
+	}
+	ensureInt(t, version, 0)
+	exists, err := sdb.hasTable("schema_version")
+	if err != nil {
+		t.Fatalf("looking for schema_version: %v", err)
+	}
+	if exists {
+		t.Fatalf("dry run created the schema_version table")
+	}
+
+	model, err := NewSQLModel(db)
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	version, err = schemaVersion(sdb)
+	if err != nil {
+		t.Fatalf("getting schema version: %v", err)
+	}
+	ensureInt(t, version, migrations[len(migrations)-1].version)
+
+	id, err := model.GetIdFromToken("bcdfghjklmnpqrstvwxy")
+	if err != nil {
+		t.Fatalf("getting id: %v", err)
+	}
+	ensureInt(t, id, 1)
+
+	pending, err = migrate(sdb, false)
+	if err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	ensureInt(t, len(pending), 0)
+}
+
+func TestPostgresDialect(t *testing.T) {
+	ensureString(t,
+		postgresDialect.rebind("UPDATE tokens SET name = ?, interval = ? WHERE id = ?"),
+		"UPDATE tokens SET name = $1, interval = $2 WHERE id = $3")
+	ensureString(t, sqliteDialect.rebind("SELECT ?"), "SELECT ?")
+	ensureString(t,
+		postgresDialect.rebind(`SELECT 'why?', 'it''s ?', "odd?" -- really?
+			FROM tokens /* ? */ WHERE name LIKE '%?%' AND id = ?`),
+		`SELECT 'why?', 'it''s ?', "odd?" -- really?
+			FROM tokens /* ? */ WHERE name LIKE '%?%' AND id = $1`)
+	ensureString(t, postgresDialect.rebind("SELECT ? -- unterminated ?"), "SELECT $1 -- unterminated ?")
+	ensureString(t, postgresDialect.rebind("SELECT 'open ?"), "SELECT 'open ?")
+
+	ensureString(t,
+		postgresDialect.ddl("id INTEGER NOT NULL PRIMARY KEY, version INTEGER NOT NULL PRIMARY KEY, "+
+			"t TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP"),
+		"id SERIAL PRIMARY KEY, version INTEGER NOT NULL PRIMARY KEY, "+
+			"t TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP")
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openSQLite(filepath.Join(dir, "kae.sqlite"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+	model, err := NewSQLModel(db)
+	if err != nil {
+		t.Fatalf("creating model: %v", err)
+	}
+	token := mustCreateToken(t, model, "backed up", "desc", 10)
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		err = writeBackup(model, &buf, compress)
+		if err != nil {
+			t.Fatalf("writing backup: %v", err)
+		}
+
+		restored := filepath.Join(dir, fmt.Sprintf("restored-%t.sqlite", compress))
+		err = restoreSQLite(&buf, restored)
+		if err != nil {
+			t.Fatalf("restoring backup: %v", err)
+		}
+
+		rdb, err := openSQLite(restored)
+		if err != nil {
+			t.Fatalf("opening restored database: %v", err)
+		}
+		rmodel, err := NewSQLModel(rdb)
+		if err != nil {
+			t.Fatalf("opening restored model: %v", err)
+		}
+		ensureInt(t, mustGetId(t, rmodel, token), 1)
+		rdb.Close()
+	}
+
+	// Garbage is rejected and leaves the target alone
+	target := filepath.Join(dir, "target.sqlite")
+	err = restoreSQLite(strings.NewReader("not a database"), target)
+	if err == nil {
+		t.Fatalf("restoring garbage did not fail")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatalf("target exists after a failed restore: %v", err)
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"kae-20230101-000000.sqlite.gz",
+		"kae-20230102-000000.sqlite.gz",
+		"kae-20230103-000000.sqlite.gz",
+		"unrelated.txt",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0o600)
+		if err != nil {
+			t.Fatalf("writing file: %v", err)
+		}
+	}
+
+	err := rotateBackups(dir, 2)
+	if err != nil {
+		t.Fatalf("rotating backups: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading dir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	ensureString(t, strings.Join(names, " "),
+		"kae-20230102-000000.sqlite.gz kae-20230103-000000.sqlite.gz unrelated.txt")
+}
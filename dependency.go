@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+)
+
+var (
+	errDependencyCycle  = errors.New("a token cannot depend on itself, directly or through other tokens")
+	errNoSuchDependency = errors.New("the token depended on does not exist")
+)
+
+// checkDependency tells whether the token id can depend on dependsOn, given
+// the live tokens in list. Depending on no token, 0, is always fine. id is 0
+// for tokens not created yet.
+func checkDependency(list ListTokens, id, dependsOn int) error {
+	if dependsOn == 0 {
+		return nil
+	}
+	byID := map[int]*Token{}
+	for _, t := range list {
+		byID[t.ID] = t
+	}
+
+	dep, ok := byID[dependsOn]
+	if !ok {
+		return errNoSuchDependency
+	}
+	// Walk up the dependencies of dep looking for id. A chain longer than the
+	// list is already a cycle, which we don't want to loop on.
+	for i := 0; dep != nil && i <= len(list); i++ {
+		if dep.ID == id {
+			return errDependencyCycle
+		}
+		dep = byID[dep.DependsOn]
+	}
+	return nil
+}
+
+// setDependency makes the token id depend on dependsOn, if it does not
+// already, and tells whether it changed. list is updated to match, so
+// several dependencies can be set in a row.
+func setDependency(m Model, list ListTokens, id, dependsOn int) (bool, error) {
+	var t *Token
+	for _, lt := range list {
+		if lt.ID == id {
+			t = lt
+		}
+	}
+	if t == nil {
+		return false, errNoSuchToken
+	}
+	if t.DependsOn == dependsOn {
+		return false, nil
+	}
+
+	u := t.update()
+	u.DependsOn = dependsOn
+	err := m.UpdateToken(id, u)
+	if err != nil {
+		return false, err
+	}
+	t.DependsOn = dependsOn
+	return true, nil
+}
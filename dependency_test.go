@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestCheckDependency(t *testing.T) {
+	list := ListTokens{
+		{ID: 1},
+		{ID: 2, DependsOn: 1},
+		{ID: 3, DependsOn: 2},
+		{ID: 4},
+	}
+	for _, tc := range []struct {
+		id, dependsOn int
+		ok            bool
+	}{
+		{1, 0, true},
+		{4, 3, true},
+		{0, 3, true},
+		{1, 1, false},
+		{1, 3, false},
+		{2, 3, false},
+		{4, 5, false},
+	} {
+		err := checkDependency(list, tc.id, tc.dependsOn)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d depending on %d: got error %v, want ok=%v", tc.id, tc.dependsOn, err, tc.ok)
+		}
+	}
+}
+
+func TestDependentTokens(t *testing.T) {
+	server := newTestServer(t)
+	gateway := mustGetId(t, server.model, mustCreateToken(t, server.model, "gateway", "network gateway", 60))
+	uploadToken := mustCreateToken(t, server.model, "upload", "upload to s3", 60)
+	upload := mustGetId(t, server.model, uploadToken)
+	for _, id := range []int{gateway, upload} {
+		ensureNoError(t, server.model.Disable(id, false))
+	}
+
+	edit := func(id int, dependsOn int) *httptest.ResponseRecorder {
+		t.Helper()
+		tk, err := server.model.GetToken(id)
+		ensureNoError(t, err)
+		return serve(t, server, "POST", "/edit/"+strconv.Itoa(id), url.Values{
+			"name":        {tk.Name},
+			"interval":    {strconv.Itoa(tk.Interval)},
+			"description": {tk.Description},
+			"depends_on":  {strconv.Itoa(dependsOn)},
+		})
+	}
+	ensureCode(t, edit(upload, gateway), http.StatusFound)
+	ensureCode(t, edit(gateway, upload), http.StatusBadRequest)
+	ensureCode(t, edit(upload, upload), http.StatusBadRequest)
+
+	state := func(id int) string {
+		t.Helper()
+		server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+		tk, err := server.model.GetToken(id)
+		ensureNoError(t, err)
+		return tk.State()
+	}
+
+	// Neither has pinged: the upload is blocked by the gateway
+	ensureString(t, state(gateway), "fired")
+	ensureString(t, state(upload), "blocked")
+	recorder := serve(t, server, "GET", "/", nil)
+	divs := parseGeneric(t, recorder.Body.String(), "div", "depends-on")
+	ensureInt(t, len(divs), 1)
+	ensureString(t, divs[0].Text, "blocked by gateway")
+	recorder = serve(t, server, "GET", "/api/tokens?state=blocked", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	var blocked []apiToken
+	ensureNoError(t, json.Unmarshal(recorder.Body.Bytes(), &blocked))
+	ensureInt(t, len(blocked), 1)
+	ensureBool(t, blocked[0].Blocked, true)
+	ensureBool(t, blocked[0].Fired, false)
+	recorder = serve(t, server, "GET", "/api/tokens?state=fired", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	var fired []apiToken
+	ensureNoError(t, json.Unmarshal(recorder.Body.Bytes(), &fired))
+	ensureInt(t, len(fired), 1)
+	ensureInt(t, fired[0].ID, gateway)
+
+	// Once the gateway is back the upload is fired on its own
+	ensureNoError(t, server.model.InsertHeartBeat(gateway, Ping{}))
+	ensureString(t, state(upload), "fired")
+	ensureString(t, state(gateway), "ok")
+	ensureNoError(t, server.model.InsertHeartBeat(upload, Ping{}))
+	ensureString(t, state(upload), "ok")
+
+	// Deleting the gateway leaves the upload on its own, and still editable
+	ensureCode(t, serve(t, server, "GET", "/delete/"+strconv.Itoa(gateway), nil), http.StatusFound)
+	tk, err := server.model.GetToken(upload)
+	ensureNoError(t, err)
+	ensureInt(t, tk.DependsOn, 0)
+	ensureCode(t, edit(upload, 0), http.StatusFound)
+	ensureCode(t, edit(upload, gateway), http.StatusBadRequest)
+}
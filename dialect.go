@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialect identifies the SQL flavour of the database behind a SQLModel. The
+// value is also the database/sql driver name.
+type dialect string
+
+const (
+	sqliteDialect   dialect = "sqlite"
+	postgresDialect dialect = "postgres"
+)
+
+// rebind rewrites the ? placeholders used throughout the model into the
+// $1, $2... form postgres expects. Question marks in string literals, quoted
+// identifiers and comments are left alone. Operators spelled with ?, like the
+// JSON ones of postgres, cannot be told apart from placeholders and must not
+// be used.
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		var open, end string
+		switch {
+		case c == '\'' || c == '"':
+			open, end = string(c), string(c)
+		case strings.HasPrefix(query[i:], "--"):
+			open, end = "--", "\n"
+		case strings.HasPrefix(query[i:], "/*"):
+			open, end = "/*", "*/"
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		default:
+			b.WriteByte(c)
+			continue
+		}
+
+		// Copy the quoted section or comment as is. A doubled quote inside
+		// a literal ends it and opens another one, which is the same.
+		j := strings.Index(query[i+len(open):], end)
+		if j < 0 {
+			b.WriteString(query[i:])
+			break
+		}
+		j += i + len(open) + len(end)
+		b.WriteString(query[i:j])
+		i = j - 1
+	}
+	return b.String()
+}
+
+var (
+	ddlSerialID  = regexp.MustCompile(`\bid INTEGER NOT NULL PRIMARY KEY\b`)
+	ddlTimestamp = regexp.MustCompile(`\bTIMESTAMP\b`)
+)
+
+// ddl adapts the SQLite flavoured schema statements used by the migrations.
+func (d dialect) ddl(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+	query = ddlSerialID.ReplaceAllString(query, "id SERIAL PRIMARY KEY")
+	return ddlTimestamp.ReplaceAllString(query, "TIMESTAMPTZ")
+}
+
+// ts returns the value to store in, or compare against, a TIMESTAMP column.
+// SQLite keeps timestamps as text, so we use the same layout as its
+// CURRENT_TIMESTAMP (plus fractional seconds) for them to compare correctly
+// as strings.
+func (d dialect) ts(t time.Time) interface{} {
+	if d == postgresDialect {
+		return t
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.999999999")
+}
+
+// sqlDB is a *sql.DB that rewrites queries for its dialect.
+type sqlDB struct {
+	*sql.DB
+	d dialect
+}
+
+// hasTable tells whether the table exists in the database.
+func (db sqlDB) hasTable(name string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if db.d == postgresDialect {
+		query = `SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = ?`
+	}
+	var n int
+	err := db.QueryRow(query, name).Scan(&n)
+	return n > 0, err
+}
+
+func (db sqlDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.d.rebind(query), args...)
+}
+
+func (db sqlDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.d.rebind(query), args...)
+}
+
+func (db sqlDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.d.rebind(query), args...)
+}
+
+func (db sqlDB) Begin() (sqlTx, error) {
+	tx, err := db.DB.Begin()
+	return sqlTx{tx, db.d}, err
+}
+
+// sqlTx is a *sql.Tx that rewrites queries for its dialect.
+type sqlTx struct {
+	*sql.Tx
+	d dialect
+}
+
+func (tx sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.d.rebind(query), args...)
+}
+
+func (tx sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.d.rebind(query), args...)
+}
+
+func (tx sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.d.rebind(query), args...)
+}
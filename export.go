@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TokenSpec is the portable definition of a token used by export and import.
+// The token string identifies the token across kae instances.
+type TokenSpec struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description" yaml:"description"`
+	Interval    int      `json:"interval" yaml:"interval"`
+	Disabled    bool     `json:"disabled" yaml:"disabled"`
+	Token       string   `json:"token" yaml:"token"`
+	Tags        []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Mode        string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Count       int      `json:"count,omitempty" yaml:"count,omitempty"`
+	// Threshold rules on the values sent with the pings
+	MinValue     *float64 `json:"min_value,omitempty" yaml:"min_value,omitempty"`
+	MaxDeviation float64  `json:"max_deviation,omitempty" yaml:"max_deviation,omitempty"`
+	// DependsOn is the token string of the token this one depends on.
+	DependsOn string `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+}
+
+// TokenExport is the document written by export and read by import.
+type TokenExport struct {
+	Tokens []TokenSpec `json:"tokens" yaml:"tokens"`
+}
+
+// ImportResult counts what an import did to each token.
+type ImportResult struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+func exportTokens(m Model) (TokenExport, error) {
+	list, err := m.GetTokens()
+	if err != nil {
+		return TokenExport{}, err
+	}
+
+	tokens := map[int]string{}
+	for _, t := range list {
+		tokens[t.ID] = t.Token
+	}
+
+	// Oldest first, so new tokens end up at the bottom of a file kept in git.
+	export := TokenExport{Tokens: []TokenSpec{}}
+	for i := len(list) - 1; i >= 0; i-- {
+		t := list[i]
+		export.Tokens = append(export.Tokens, TokenSpec{
+			Name:         t.Name,
+			Description:  t.Description,
+			Interval:     t.Interval,
+			Disabled:     t.Disabled,
+			Token:        t.Token,
+			Tags:         t.Tags,
+			Mode:         t.Rule.Mode,
+			Count:        t.Rule.Count,
+			MinValue:     t.Rule.MinValue,
+			MaxDeviation: t.Rule.MaxDeviation,
+			DependsOn:    tokens[t.DependsOn],
+		})
+	}
+	return export, nil
+}
+
+// importTokens creates or updates the tokens in the export so they match it.
+// Importing the same document twice leaves everything unchanged the second
+// time. Tokens not in the document are left alone.
+func importTokens(m Model, export TokenExport) (ImportResult, error) {
+	var result ImportResult
+	err := export.validate()
+	if err != nil {
+		return result, err
+	}
+
+	ids := make([]int, len(export.Tokens))
+	unchanged := make([]bool, len(export.Tokens))
+	for i, spec := range export.Tokens {
+		existing, err := tokenByString(m, spec.Token)
+		if err != nil {
+			return result, err
+		}
+		if existing != nil && spec.matches(existing) {
+			ids[i], unchanged[i] = existing.ID, true
+			result.Unchanged++
+			continue
+		}
+
+		id, err := m.ImportToken(&Token{
+			Token:       spec.Token,
+			Name:        spec.Name,
+			Description: spec.Description,
+			Interval:    spec.Interval,
+			Disabled:    spec.Disabled,
+		})
+		if err != nil {
+			return result, fmt.Errorf("importing %q: %w", spec.Name, err)
+		}
+		ids[i] = id
+		// The dependency is set below, once all the tokens exist.
+		dependsOn := 0
+		if existing != nil {
+			dependsOn = existing.DependsOn
+		}
+		err = m.UpdateToken(id, spec.update(dependsOn))
+		if err != nil {
+			return result, fmt.Errorf("importing %q: %w", spec.Name, err)
+		}
+
+		if existing == nil {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+
+	// Dependencies go last, as tokens can depend on tokens further down.
+	list, err := m.GetTokens()
+	if err != nil {
+		return result, err
+	}
+	for i, spec := range export.Tokens {
+		var dependsOn int
+		if spec.DependsOn != "" {
+			dep, err := tokenByString(m, spec.DependsOn)
+			if err != nil {
+				return result, err
+			}
+			if dep == nil {
+				return result, fmt.Errorf("importing %q: depends on an unknown token", spec.Name)
+			}
+			dependsOn = dep.ID
+		}
+		changed, err := setDependency(m, list, ids[i], dependsOn)
+		if err != nil {
+			return result, fmt.Errorf("importing %q: %w", spec.Name, err)
+		}
+		if changed && unchanged[i] {
+			result.Unchanged--
+			result.Updated++
+		}
+	}
+	return result, nil
+}
+
+// validate normalizes and checks every token in the export.
+func (export TokenExport) validate() error {
+	seen := map[string]bool{}
+	for i := range export.Tokens {
+		spec := &export.Tokens[i]
+		err := spec.normalize()
+		if err != nil {
+			return fmt.Errorf("token %d (%q): %w", i+1, spec.Name, err)
+		}
+		if seen[spec.Token] {
+			return fmt.Errorf("token %d (%q): token string used more than once", i+1, spec.Name)
+		}
+		seen[spec.Token] = true
+	}
+	return nil
+}
+
+// tokenByString returns the live token currently using the token string, if
+// any. Rotated token strings do not count.
+func tokenByString(m Model, token string) (*Token, error) {
+	id, err := m.GetIdFromToken(token)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	t, err := m.GetToken(id)
+	if err != nil || t == nil || t.Token != token {
+		return nil, err
+	}
+	return t, nil
+}
+
+// normalize validates the spec with the same rules as the token forms.
+func (spec *TokenSpec) normalize() error {
+	spec.Name = strings.TrimSpace(spec.Name)
+	spec.Description = strings.TrimSpace(spec.Description)
+	spec.Tags = parseTags(strings.Join(spec.Tags, ","))
+	sort.Strings(spec.Tags)
+	spec.Mode = spec.rule().withDefaults().Mode
+
+	err := tokenForm{
+		Name:        spec.Name,
+		Description: spec.Description,
+		Interval:    spec.Interval,
+		Rule:        spec.rule(),
+	}.validate()
+	switch {
+	case err != nil:
+		return err
+	case spec.Token == "":
+		return errors.New("token is required")
+	case strings.Trim(spec.Token, urlSafeChars) != "":
+		return errors.New("token has characters that are not URL safe")
+	case spec.DependsOn == spec.Token:
+		return errors.New("a token cannot depend on itself")
+	}
+	return nil
+}
+
+func (spec TokenSpec) matches(t *Token) bool {
+	return spec.Name == t.Name &&
+		spec.Description == t.Description &&
+		spec.Interval == t.Interval &&
+		spec.Disabled == t.Disabled &&
+		strings.Join(spec.Tags, ",") == strings.Join(t.Tags, ",") &&
+		spec.rule().equal(t.Rule)
+}
+
+func (spec TokenSpec) rule() Rule {
+	return Rule{Mode: spec.Mode, Count: spec.Count, MinValue: spec.MinValue, MaxDeviation: spec.MaxDeviation}
+}
+
+func (spec TokenSpec) update(dependsOn int) TokenUpdate {
+	return TokenUpdate{
+		Name:        spec.Name,
+		Description: spec.Description,
+		Interval:    spec.Interval,
+		Tags:        spec.Tags,
+		Rule:        spec.rule(),
+		DependsOn:   dependsOn,
+	}
+}
+
+// formatFromPath picks the format from the file extension, JSON by default.
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatJSON
+	}
+}
+
+func marshalExport(export TokenExport, format string) ([]byte, error) {
+	switch format {
+	case formatJSON:
+		data, err := json.MarshalIndent(export, "", "  ")
+		return append(data, '\n'), err
+	case formatYAML:
+		return yaml.Marshal(export)
+	default:
+		return nil, fmt.Errorf("unknown format %q, want %s or %s", format, formatJSON, formatYAML)
+	}
+}
+
+func unmarshalExport(data []byte, format string) (TokenExport, error) {
+	var export TokenExport
+	switch format {
+	case formatJSON:
+		return export, json.Unmarshal(data, &export)
+	case formatYAML:
+		return export, yaml.Unmarshal(data, &export)
+	default:
+		return export, fmt.Errorf("unknown format %q, want %s or %s", format, formatJSON, formatYAML)
+	}
+}
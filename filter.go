@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TokenFilter holds the home page filters. The zero value matches every token.
+type TokenFilter struct {
+	Tag    string
+	State  string
+	Search string
+	Group  string
+}
+
+// TokenGroup is a set of tokens rendered together under a heading.
+type TokenGroup struct {
+	Name   string
+	Tokens ListTokens
+}
+
+var tokenStates = []string{"fired", "blocked", "ok", "disabled"}
+
+func filterFromQuery(q url.Values) TokenFilter {
+	return TokenFilter{
+		Tag:    strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+		State:  strings.TrimSpace(q.Get("state")),
+		Search: strings.TrimSpace(q.Get("q")),
+		Group:  strings.TrimSpace(q.Get("group")),
+	}
+}
+
+// Apply returns the tokens from the list that match the filter.
+func (f TokenFilter) Apply(list ListTokens) ListTokens {
+	search := strings.ToLower(f.Search)
+	var out ListTokens
+	for _, t := range list {
+		if f.Tag != "" && !hasTag(t, f.Tag) {
+			continue
+		}
+		if f.State != "" && t.State() != f.State {
+			continue
+		}
+		if search != "" &&
+			!strings.Contains(strings.ToLower(t.Name), search) &&
+			!strings.Contains(strings.ToLower(t.Description), search) {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// GroupBy splits the list in groups by tag or by state. Any other value of
+// Group returns a single unnamed group. A token with several tags shows up
+// in all of their groups.
+func (f TokenFilter) GroupBy(list ListTokens) []TokenGroup {
+	switch f.Group {
+	case "state":
+		var groups []TokenGroup
+		for _, state := range tokenStates {
+			g := TokenGroup{Name: state}
+			for _, t := range list {
+				if t.State() == state {
+					g.Tokens = append(g.Tokens, t)
+				}
+			}
+			if len(g.Tokens) > 0 {
+				groups = append(groups, g)
+			}
+		}
+		return groups
+	case "tag":
+		byTag := map[string]ListTokens{}
+		var untagged ListTokens
+		for _, t := range list {
+			if len(t.Tags) == 0 {
+				untagged = append(untagged, t)
+			}
+			for _, tag := range t.Tags {
+				byTag[tag] = append(byTag[tag], t)
+			}
+		}
+		var names []string
+		for name := range byTag {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var groups []TokenGroup
+		for _, name := range names {
+			groups = append(groups, TokenGroup{Name: name, Tokens: byTag[name]})
+		}
+		if len(untagged) > 0 {
+			groups = append(groups, TokenGroup{Name: "untagged", Tokens: untagged})
+		}
+		return groups
+	default:
+		return []TokenGroup{{Tokens: list}}
+	}
+}
+
+func hasTag(t *Token, tag string) bool {
+	for _, tt := range t.Tags {
+		if tt == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags splits a comma separated list of tags, dropping empty entries and
+// duplicates.
+func parseTags(s string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits match the column sizes of the tokens table.
+const (
+	maxNameLen        = 255
+	maxDescriptionLen = 1000
+)
+
+// tokenForm holds the user editable fields of a token as submitted by the
+// create and edit forms.
+type tokenForm struct {
+	Name        string
+	Description string
+	Interval    int
+	Tags        []string
+	Rule        Rule
+	// DependsOn is the id of the token this one depends on, 0 if none. It is
+	// checked against the other tokens with checkDependency.
+	DependsOn int
+}
+
+// update returns the fields of the form to be stored with UpdateToken.
+func (f tokenForm) update() TokenUpdate {
+	return TokenUpdate{
+		Name:        f.Name,
+		Description: f.Description,
+		Interval:    f.Interval,
+		Tags:        f.Tags,
+		Rule:        f.Rule,
+		DependsOn:   f.DependsOn,
+	}
+}
+
+// parseTokenForm reads and validates the token fields of the request. The
+// returned form is filled in even when validation fails so it can be shown
+// back to the user.
+func parseTokenForm(r *http.Request) (tokenForm, error) {
+	f := tokenForm{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Tags:        parseTags(r.FormValue("tags")),
+		Rule:        Rule{Mode: strings.TrimSpace(r.FormValue("mode"))}.withDefaults(),
+	}
+
+	interval := strings.TrimSpace(r.FormValue("interval"))
+	if interval == "" {
+		return f, errors.New("interval is required")
+	}
+	var err error
+	f.Interval, err = strconv.Atoi(interval)
+	if err != nil {
+		return f, errors.New("interval must be a positive number of seconds")
+	}
+	if count := strings.TrimSpace(r.FormValue("count")); count != "" {
+		f.Rule.Count, err = strconv.Atoi(count)
+		if err != nil {
+			return f, errors.New("count must be a number of heartbeats")
+		}
+	}
+	if v := strings.TrimSpace(r.FormValue("depends_on")); v != "" {
+		f.DependsOn, err = strconv.Atoi(v)
+		if err != nil {
+			return f, errors.New("invalid token to depend on")
+		}
+	}
+	if v := strings.TrimSpace(r.FormValue("min_value")); v != "" {
+		minValue, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return f, errors.New("min value must be a number")
+		}
+		f.Rule.MinValue = &minValue
+	}
+	if v := strings.TrimSpace(r.FormValue("max_deviation")); v != "" {
+		f.Rule.MaxDeviation, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return f, errors.New("max deviation must be a positive percentage")
+		}
+	}
+	return f, f.validate()
+}
+
+// validate checks the fields against the rules shared by the forms, import
+// and the monitors file.
+func (f tokenForm) validate() error {
+	switch {
+	case f.Name == "":
+		return errors.New("name is required")
+	case len(f.Name) > maxNameLen:
+		return fmt.Errorf("name is longer than %d characters", maxNameLen)
+	case f.Description == "":
+		return errors.New("description is required")
+	case len(f.Description) > maxDescriptionLen:
+		return fmt.Errorf("description is longer than %d characters", maxDescriptionLen)
+	case f.Interval <= 0:
+		return errors.New("interval must be a positive number of seconds")
+	}
+	return f.Rule.validate()
+}
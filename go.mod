@@ -3,13 +3,17 @@ module github.com/drio/kea
 go 1.20
 
 require (
+	github.com/emersion/go-smtp v0.21.3
 	github.com/go-chi/chi v1.5.4
+	github.com/lib/pq v1.10.9
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.21.2
 )
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
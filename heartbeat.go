@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+)
+
+// hbResult is what happened to a heartbeat.
+type hbResult int
+
+const (
+	hbRecorded hbResult = iota
+	hbCoalesced
+	hbOrphan
+	hbLimitedByToken
+	hbLimitedByIP
+)
+
+// String is how the result is reported by /hb/batch.
+func (r hbResult) String() string {
+	switch r {
+	case hbRecorded:
+		return "recorded"
+	case hbCoalesced:
+		return "coalesced"
+	case hbOrphan:
+		return "unknown"
+	default:
+		return "rate_limited"
+	}
+}
+
+func (r hbResult) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// heartbeat is the path every heartbeat goes through, whichever way it came
+// in: rate limits, token lookup, orphan tracking and coalescing. p.RemoteAddr
+// is the address rate limited per IP.
+func (s *Server) heartbeat(token string, p Ping) (hbResult, error) {
+	id, result, err := s.admitHeartbeat(token, p)
+	if err != nil || result != hbRecorded {
+		return result, err
+	}
+	err = s.model.InsertHeartBeat(id, p)
+	if err != nil {
+		s.coalescer.forget(id)
+		return 0, fmt.Errorf("heartbeat: %w", err)
+	}
+	s.hbStats.recorded.Add(1)
+	return hbRecorded, nil
+}
+
+// admitHeartbeat does everything heartbeat does but storing the ping. When
+// the result is hbRecorded it returns the id of the token the ping has to be
+// stored for.
+//
+// The pings of count tokens are what their rule is about, so they are neither
+// limited per token nor coalesced.
+func (s *Server) admitHeartbeat(token string, p Ping) (int, hbResult, error) {
+	if !s.ipLimiter.allow(p.RemoteAddr) {
+		s.hbStats.limitedByIP.Add(1)
+		return 0, hbLimitedByIP, nil
+	}
+	return s.admitToken(token, p)
+}
+
+// admitToken is admitHeartbeat once the client address has been let through,
+// which /hb/batch does once for the whole request.
+func (s *Server) admitToken(token string, p Ping) (int, hbResult, error) {
+	id, err := s.model.GetIdFromToken(token)
+	if err != nil {
+		return 0, 0, fmt.Errorf("checking for token: %w", err)
+	}
+	if id == 0 {
+		if !s.tokenLimiter.allow(token) {
+			s.hbStats.limitedByToken.Add(1)
+			return 0, hbLimitedByToken, nil
+		}
+		s.hbStats.orphans.Add(1)
+		err = s.model.InsertOrphanPing(OrphanPing{
+			Token:      truncate(token, 255),
+			Time:       p.Time,
+			RemoteAddr: p.RemoteAddr,
+			UserAgent:  p.UserAgent,
+		})
+		if err != nil {
+			s.logger.Printf("error recording orphan ping: %v", err)
+		}
+		return 0, hbOrphan, nil
+	}
+
+	if s.tokenLimiter == nil && s.coalescer == nil {
+		return id, hbRecorded, nil
+	}
+	t, err := s.model.GetToken(id)
+	if err != nil {
+		return 0, 0, fmt.Errorf("getting token: %w", err)
+	}
+	if t == nil || t.Rule.counts() {
+		return id, hbRecorded, nil
+	}
+	if !s.tokenLimiter.allow(token) {
+		s.hbStats.limitedByToken.Add(1)
+		return 0, hbLimitedByToken, nil
+	}
+	if s.coalescer.coalesce(t, p) {
+		s.hbStats.coalesced.Add(1)
+		return id, hbCoalesced, nil
+	}
+	return id, hbRecorded, nil
+}
+
+func (s *Server) hbToken(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if token == "" {
+		s.badRequestError(w, "token not provided", nil)
+		return
+	}
+
+	ping, err := s.pingFromRequest(r, time.Now())
+	if err != nil {
+		s.badRequestError(w, err.Error(), err)
+		return
+	}
+
+	result, err := s.heartbeat(token, ping)
+	if err != nil {
+		s.internalError(w, "heartbeat", err)
+		return
+	}
+
+	code, msg := http.StatusOK, fmt.Sprintf("ok t=%s", token)
+	switch result {
+	case hbCoalesced:
+		msg += " (coalesced)"
+	case hbOrphan:
+		code, msg = s.orphanStatus, msg+" (nd)"
+		if code >= 300 {
+			msg = fmt.Sprintf("error unknown token t=%s", token)
+		}
+	case hbLimitedByToken, hbLimitedByIP:
+		s.setRetryAfter(w, result)
+		code, msg = http.StatusTooManyRequests, fmt.Sprintf("error rate limited t=%s", token)
+	}
+
+	// respond to the client
+	w.WriteHeader(code)
+	_, err = w.Write([]byte(msg))
+	if err != nil {
+		s.logger.Printf("error writing back to the user: %v", err)
+	}
+}
+
+// setRetryAfter tells the client when the limiter that refused a heartbeat
+// lets the next one through.
+func (s *Server) setRetryAfter(w http.ResponseWriter, result hbResult) {
+	limiter := s.tokenLimiter
+	if result == hbLimitedByIP {
+		limiter = s.ipLimiter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(limiter.retryAfter().Seconds())))
+}
+
+// Largest number of pings in a /hb/batch request.
+const maxBatchSize = 1000
+
+// hbBatchResult tells what happened to each ping of a batch, in order.
+type hbBatchResult struct {
+	Token  string   `json:"token"`
+	Result hbResult `json:"result"`
+}
+
+// hbBatch takes a JSON list of pings, each with a token and the parameters of
+// /hb/{token}, and stores them in a single transaction. Invalid pings reject
+// the whole batch. The request counts as a single heartbeat for the limit per
+// client address, and each ping for the limit of its token.
+func (s *Server) hbBatch(w http.ResponseWriter, r *http.Request) {
+	var batch []pingInput
+	err := json.NewDecoder(io.LimitReader(r.Body, maxImportSize)).Decode(&batch)
+	if err != nil {
+		s.badRequestError(w, "parsing batch: "+err.Error(), err)
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		s.badRequestError(w, fmt.Sprintf("a batch has between 1 and %d pings, got %d", maxBatchSize, len(batch)), nil)
+		return
+	}
+
+	base := Ping{
+		Time:       time.Now(),
+		RemoteAddr: truncate(clientIP(r, s.proxies), 255),
+		UserAgent:  truncate(r.UserAgent(), 1000),
+		Method:     r.Method,
+	}
+	pings := make([]Ping, len(batch))
+	for i, in := range batch {
+		if in.Token == "" {
+			s.badRequestError(w, fmt.Sprintf("ping %d: token not provided", i+1), nil)
+			return
+		}
+		pings[i], err = s.newPing(in, base)
+		if err != nil {
+			s.badRequestError(w, fmt.Sprintf("ping %d (%s): %s", i+1, in.Token, err), err)
+			return
+		}
+	}
+
+	if !s.ipLimiter.allow(base.RemoteAddr) {
+		s.hbStats.limitedByIP.Add(int64(len(batch)))
+		s.setRetryAfter(w, hbLimitedByIP)
+		http.Error(w, "error rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	results := make([]hbBatchResult, len(batch))
+	var hbs []HeartBeat
+	limited := 0
+	for i, in := range batch {
+		id, result, err := s.admitToken(in.Token, pings[i])
+		if err != nil {
+			s.internalError(w, "heartbeat", err)
+			return
+		}
+		results[i] = hbBatchResult{Token: in.Token, Result: result}
+		switch result {
+		case hbRecorded:
+			hbs = append(hbs, HeartBeat{TokenID: id, Ping: pings[i]})
+		case hbLimitedByToken:
+			limited++
+		}
+	}
+	if limited == len(batch) {
+		s.setRetryAfter(w, hbLimitedByToken)
+		http.Error(w, "error rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	err = s.model.InsertHeartBeats(hbs)
+	if err != nil {
+		for _, hb := range hbs {
+			s.coalescer.forget(hb.TokenID)
+		}
+		s.internalError(w, "heartbeats", err)
+		return
+	}
+	s.hbStats.recorded.Add(int64(len(hbs)))
+	s.writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server) hbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.hbStats.snapshot())
+}
+
+// Largest job output, in bytes, kept with a ping. Longer outputs keep the end.
+const maxPingOutput = 10 << 10
+
+// Clients whose clock runs ahead of ours by up to this much are not rejected.
+// Their pings are recorded now.
+const maxPingClockSkew = time.Minute
+
+// pingInput is a heartbeat as sent by a client, before it is validated.
+type pingInput struct {
+	Token    string   `json:"token"`
+	Status   string   `json:"status"`
+	ExitCode *int     `json:"exit_code"`
+	Duration *float64 `json:"duration"`
+	TS       *float64 `json:"ts"`
+	Output   string   `json:"output"`
+	Host     string   `json:"host"`
+	RunID    string   `json:"run_id"`
+	Value    *float64 `json:"value"`
+	Unit     string   `json:"unit"`
+}
+
+// pingFromRequest reads the run details of a heartbeat: status, exit_code and
+// duration (in seconds) from the query string, and the output of the job from
+// the body of a POST. See newPing for the rest of the parameters.
+func (s *Server) pingFromRequest(r *http.Request, now time.Time) (Ping, error) {
+	q := r.URL.Query()
+	in := pingInput{
+		Status: q.Get("status"),
+		Host:   q.Get("host"),
+		RunID:  q.Get("run_id"),
+		Unit:   q.Get("unit"),
+	}
+	p := Ping{
+		Time:       now,
+		RemoteAddr: truncate(clientIP(r, s.proxies), 255),
+		UserAgent:  truncate(r.UserAgent(), 1000),
+		Method:     r.Method,
+	}
+
+	if v := q.Get("exit_code"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid exit_code %q", v)
+		}
+		in.ExitCode = &code
+	}
+	for _, f := range []struct {
+		name string
+		dst  **float64
+	}{
+		{"duration", &in.Duration},
+		{"ts", &in.TS},
+		{"value", &in.Value},
+	} {
+		if v := q.Get(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+			*f.dst = &n
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		out, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize))
+		if err != nil {
+			return p, err
+		}
+		in.Output = string(out)
+	}
+	return s.newPing(in, p)
+}
+
+// newPing validates in and fills the fields of p with it. A ping with a non
+// zero exit code and no status fails. Outputs are cut to maxPingOutput.
+//
+// Clients that could not reach us send ts, the unix time of the ping, when
+// they retry later. It is accepted if it is at most maxPingAge old; the ping
+// happened at p.Time otherwise.
+//
+// Clients can also tell which host sent the ping and which run it belongs to
+// with host and run_id, and send a measurement with value and unit.
+func (s *Server) newPing(in pingInput, p Ping) (Ping, error) {
+	p.Status = in.Status
+	switch p.Status {
+	case "", PingOK, PingStart, PingFail:
+	default:
+		return p, fmt.Errorf("invalid status %q", p.Status)
+	}
+	p.ExitCode = in.ExitCode
+	if p.Status == "" && p.ExitCode != nil && *p.ExitCode != 0 {
+		p.Status = PingFail
+	}
+	if p.Status == "" {
+		p.Status = PingOK
+	}
+
+	if in.Duration != nil {
+		if *in.Duration < 0 {
+			return p, fmt.Errorf("invalid duration %g", *in.Duration)
+		}
+		p.Duration = time.Duration(*in.Duration * float64(time.Second))
+	}
+
+	if in.TS != nil && s.maxPingAge > 0 {
+		now := p.Time
+		ts := time.Unix(0, int64(*in.TS*float64(time.Second)))
+		switch {
+		case ts.Before(now.Add(-s.maxPingAge)):
+			return p, fmt.Errorf("ts %.3f is older than %s", *in.TS, s.maxPingAge)
+		case ts.After(now.Add(maxPingClockSkew)):
+			return p, fmt.Errorf("ts %.3f is in the future", *in.TS)
+		case ts.Before(now):
+			p.Time = ts
+		}
+	}
+
+	p.Output = tail(in.Output, maxPingOutput)
+	p.Host = truncate(in.Host, 255)
+	p.RunID = truncate(in.RunID, 255)
+
+	if in.Value != nil && (math.IsNaN(*in.Value) || math.IsInf(*in.Value, 0)) {
+		return p, fmt.Errorf("invalid value %g", *in.Value)
+	}
+	p.Value = in.Value
+	p.Unit = truncate(in.Unit, 32)
+	return p, nil
+}
+
+// tail returns the last n bytes of s at most, starting on a whole character.
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := len(s) - n
+	for i < len(s) && !utf8.RuneStart(s[i]) {
+		i++
+	}
+	return s[i:]
+}
+
+// truncate returns the first n bytes of s at most, ending on a whole
+// character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Longest line, or datagram, taken by the UDP and TCP listeners.
+const maxRawLineSize = 1024
+
+// How long a TCP connection can stay idle between lines.
+const tcpIdleTimeout = time.Minute
+
+// serveUDP takes heartbeats as datagrams of "token[ status]" lines. Nothing
+// is sent back: the pings are fire and forget.
+func (s *Server) serveUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxRawLineSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		remote := addr.String()
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if strings.TrimSpace(line) != "" {
+				s.rawHeartbeat(line, "UDP", remote)
+			}
+		}
+	}
+}
+
+// serveTCP takes heartbeats as "token[ status]" lines and answers each one
+// with a line like the body of /hb/{token}.
+func (s *Server) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+func (s *Server) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, maxRawLineSize), maxRawLineSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+		_, err := fmt.Fprintln(conn, s.rawHeartbeat(line, "TCP", remote))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rawHeartbeat records a "token[ status]" line received by method from
+// remote and returns the reply.
+func (s *Server) rawHeartbeat(line, method, remote string) string {
+	token, status, err := parseRawHeartbeat(line)
+	if err != nil {
+		return "error " + err.Error()
+	}
+
+	result, err := s.heartbeat(token, Ping{
+		Time:       time.Now(),
+		Status:     status,
+		RemoteAddr: remote,
+		Method:     method,
+	})
+	if err != nil {
+		s.logger.Printf("%s heartbeat: %v", method, err)
+		return "error heartbeat"
+	}
+	switch result {
+	case hbCoalesced:
+		return fmt.Sprintf("ok t=%s (coalesced)", token)
+	case hbOrphan:
+		if s.orphanStatus >= 300 {
+			return fmt.Sprintf("error unknown token t=%s", token)
+		}
+		return fmt.Sprintf("ok t=%s (nd)", token)
+	case hbLimitedByToken, hbLimitedByIP:
+		return fmt.Sprintf("error rate limited t=%s", token)
+	}
+	return fmt.Sprintf("ok t=%s", token)
+}
+
+// parseRawHeartbeat splits a "token[ status]" line.
+func parseRawHeartbeat(line string) (string, string, error) {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 1:
+		return fields[0], PingOK, nil
+	case len(fields) == 2:
+		switch fields[1] {
+		case PingOK, PingStart, PingFail:
+			return fields[0], fields[1], nil
+		}
+		return "", "", fmt.Errorf("invalid status %q", fields[1])
+	}
+	return "", "", errors.New("want a token and an optional status")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPHeartBeats(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "sensor", "temperature sensor", 60)
+	id := mustGetId(t, server.model, token)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensureNoError(t, err)
+	defer l.Close()
+	go server.serveTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	ensureNoError(t, err)
+	defer conn.Close()
+	replies := bufio.NewScanner(conn)
+	send := func(line string) string {
+		t.Helper()
+		_, err := fmt.Fprintln(conn, line)
+		ensureNoError(t, err)
+		if !replies.Scan() {
+			t.Fatalf("no reply to %q: %v", line, replies.Err())
+		}
+		return replies.Text()
+	}
+
+	ensureString(t, send(token), "ok t="+token)
+	ensureString(t, send(token+" fail"), "ok t="+token)
+	ensureString(t, send(token+" done"), `error invalid status "done"`)
+	ensureString(t, send("typo"), "ok t=typo (nd)")
+
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingFail)
+	ensureString(t, last.Method, "TCP")
+	ensureString(t, last.RemoteAddr, "127.0.0.1")
+}
+
+func TestUDPHeartBeats(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "sensor", "temperature sensor", 60)
+	id := mustGetId(t, server.model, token)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ensureNoError(t, err)
+	defer pc.Close()
+	go server.serveUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	ensureNoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(token + " start\n" + token + "\n"))
+	ensureNoError(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pings, err := server.model.GetPings(id, 10)
+		ensureNoError(t, err)
+		if len(pings) == 2 {
+			ensureString(t, pings[0].Method, "UDP")
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pings, want 2", len(pings))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingOK)
+}
@@ -6,93 +6,194 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/middleware"
+	_ "github.com/lib/pq"
 	_ "modernc.org/sqlite"
 )
 
+const defaultDBPath = "keep-an-eye.sqlite"
+
 func main() {
-	// Config defaults
-	port := 3500
-	delaySecsDefault := 5
-	dbPath := "keep-an-eye.sqlite"
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			exitOnError(cmd(os.Args[2:]))
+			return
+		}
+	}
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage: kae [options]
-
-Options:
-  -delaySecs  number of seconds between heartbeat updates (default %d)
-
-Environment variables:
-  PORT       HTTP port to listen on (default %d)
-  KAE_DB     path to SQLite 3 database (default %q)
-  KAE_USER   basic auth username (default no basic auth)
-  KAE_PASS   basic auth password (default no basic auth)
-`, delaySecsDefault, port, dbPath)
-	}
-	delaySecs := flag.Int("delaySecs", delaySecsDefault, fmt.Sprintf("default: %d", delaySecsDefault))
-	flag.Parse()
-
-	// Parse config from environment variables
-	var err error
-	if portEnv, ok := os.LookupEnv("PORT"); ok {
-		port, err = strconv.Atoi(portEnv)
-		if err != nil {
-			exitOnError(err)
-		}
-	}
-	if dbEnv, ok := os.LookupEnv("KAE_DB"); ok {
-		dbPath = dbEnv
-	}
-	var user, pass string
-	if userEnv, ok := os.LookupEnv("KAE_USER"); ok {
-		user = userEnv
-	}
-	if passEnv, ok := os.LookupEnv("KAE_PASS"); ok {
-		pass = passEnv
-	}
-	if user != "" && pass == "" {
-		exitOnError(errors.New("KAE_USER provided but missing KAE_PASS"))
-	}
-	if user == "" && pass != "" {
-		exitOnError(errors.New("KAE_PASS provided but missing KAE_USER"))
+       kae migrate [-dry-run]
+       kae backup [-gzip] [-o file]
+       kae restore [-force] file
+       kae export [-format json|yaml] [-o file]
+       kae import [-format json|yaml] file
+       kae config print [options]
+       kae token list|show|create|enable|disable|delete
+       kae run -token token -- command [args...]
+`)
+		defaultConfig().usage(flag.CommandLine.Output())
 	}
-
-	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath))
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
 	exitOnError(err)
-	model, err := NewSQLModel(db)
+
+	model, dbDesc, err := openModel(cfg)
 	exitOnError(err)
 	am := noAuthMiddleware
-	if user != "" && pass != "" {
-		am = middleware.BasicAuth("kae site", map[string]string{user: pass})
+	authenticated := cfg.User != "" && cfg.Pass != ""
+	if authenticated {
+		am = middleware.BasicAuth("kae site", map[string]string{cfg.User: cfg.Pass})
 	}
 	server, err := NewServer(ServerOpts{
 		model:          model,
 		logger:         log.Default(),
 		authMiddleware: am,
+		authenticated:  authenticated,
+		rotateOverlap:  time.Duration(cfg.RotateOverlapSecs) * time.Second,
+		maxPingAge:     time.Duration(cfg.MaxPingAgeSecs) * time.Second,
+		orphanStatus:   cfg.OrphanStatus,
+		trustedProxies: cfg.trustedProxies(),
+		tokenRate:      cfg.HBTokenRate,
+		ipRate:         cfg.HBIPRate,
+		minPingSpacing: time.Duration(cfg.HBMinSpacingSecs) * time.Second,
 	})
 	exitOnError(err)
 
+	if cfg.Monitors != "" {
+		exitOnError(reconcileFile(model, cfg.Monitors, server.logger))
+		go reconcileOnSIGHUP(model, cfg.Monitors, server.logger)
+	}
+
 	log.Printf("starting background job")
 	go server.runBackgroundJob(bgJobOpts{
 		loop: true,
 		delayFn: func() {
-			server.logger.Printf("runBackgrondJob: Sleeping for %d secs", *delaySecs)
-			time.Sleep(time.Duration(*delaySecs) * time.Second)
+			server.logger.Printf("runBackgrondJob: Sleeping for %d secs", cfg.DelaySecs)
+			time.Sleep(time.Duration(cfg.DelaySecs) * time.Second)
 		},
 	})
 
-	log.Printf("config: port=%d db=%q delaySecs=%d", port, dbPath, *delaySecs)
-	log.Printf("listening on http://:%d", port)
-	exitOnError(http.ListenAndServe(":"+strconv.Itoa(port), server))
-	err = http.ListenAndServe(":"+strconv.Itoa(port), server)
+	if cfg.BackupDir != "" {
+		b, ok := backuperFor(model)
+		if !ok {
+			exitOnError(errBackupUnsupported)
+		}
+		exitOnError(os.MkdirAll(cfg.BackupDir, 0o700))
+		log.Printf("starting scheduled backups to %s every %d secs", cfg.BackupDir, cfg.BackupEverySecs)
+		go runScheduledBackups(b, scheduledBackupOpts{
+			dir:      cfg.BackupDir,
+			every:    time.Duration(cfg.BackupEverySecs) * time.Second,
+			keep:     cfg.BackupKeep,
+			compress: true,
+			logger:   server.logger,
+		})
+	}
+
+	if cfg.SMTPAddr != "" {
+		log.Printf("listening for heartbeats to {token}@%s on smtp://%s", cfg.SMTPDomain, cfg.SMTPAddr)
+		go func() {
+			exitOnError(server.newSMTPServer(cfg.SMTPAddr, cfg.SMTPDomain).ListenAndServe())
+		}()
+	}
+
+	if cfg.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", cfg.UDPAddr)
+		exitOnError(err)
+		log.Printf("listening for heartbeats on udp://%s", cfg.UDPAddr)
+		go func() { exitOnError(server.serveUDP(conn)) }()
+	}
+	if cfg.TCPAddr != "" {
+		l, err := net.Listen("tcp", cfg.TCPAddr)
+		exitOnError(err)
+		log.Printf("listening for heartbeats on tcp://%s", cfg.TCPAddr)
+		go func() { exitOnError(server.serveTCP(l)) }()
+	}
+
+	log.Printf("config: port=%d db=%s delaySecs=%d rotateOverlapSecs=%d", cfg.Port, dbDesc, cfg.DelaySecs, cfg.RotateOverlapSecs)
+	log.Printf("listening on http://:%d", cfg.Port)
+	exitOnError(http.ListenAndServe(":"+strconv.Itoa(cfg.Port), server))
+	err = http.ListenAndServe(":"+strconv.Itoa(cfg.Port), server)
 	exitOnError(err)
 }
 
+// reconcileOnSIGHUP reloads the monitors file every time kae gets a SIGHUP.
+// Errors are logged and the tokens are left as they were.
+func reconcileOnSIGHUP(model Model, path string, logger Logger) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := reconcileFile(model, path, logger)
+		if err != nil {
+			logger.Printf("reconcile: %s", err)
+		}
+	}
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", fmt.Sprintf("file:%s?_foreign_keys=on", path))
+}
+
+// memoryURL selects the in-memory model in db_url.
+const memoryURL = "memory://"
+
+// openModel returns the model selected by the config along with a
+// description of it for the logs.
+func openModel(cfg *Config) (Model, string, error) {
+	if cfg.DBURL == memoryURL {
+		model := NewMemModel()
+		return model, memoryURL, model.SetTokenGenerator(cfg.tokenGenerator())
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	model, err := newSQLModel(db)
+	if err != nil {
+		return nil, "", err
+	}
+	return model, describeDB(cfg), model.SetTokenGenerator(cfg.tokenGenerator())
+}
+
+// openDB opens postgres when db_url is set and the SQLite file in db
+// otherwise.
+func openDB(cfg *Config) (sqlDB, error) {
+	if cfg.DBURL != "" {
+		if cfg.DBURL == memoryURL {
+			return sqlDB{}, errors.New("the in-memory store has no database")
+		}
+		db, err := sql.Open("postgres", cfg.DBURL)
+		return sqlDB{db, postgresDialect}, err
+	}
+	db, err := openSQLite(cfg.DBPath)
+	return sqlDB{db, sqliteDialect}, err
+}
+
+func describeDB(cfg *Config) string {
+	if cfg.DBURL != "" {
+		return redactDSN(cfg.DBURL)
+	}
+	return strconv.Quote(cfg.DBPath)
+}
+
+// redactDSN hides the password of a DSN so it can be logged.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "(invalid dsn)"
+	}
+	return u.Redacted()
+}
+
 func exitOnError(err error) {
 	if err != nil {
 		log.Fatal(err)
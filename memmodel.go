@@ -0,0 +1,447 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemModel implements Model in memory. It is meant for tests and throwaway
+// instances: everything is lost when the process exits.
+type MemModel struct {
+	mu      sync.Mutex
+	tokens  TokenGenerator
+	nextID  int
+	byID    map[int]*memToken
+	secrets []memSecret
+	orphans []OrphanPing
+}
+
+type memToken struct {
+	Token
+	deleted bool
+	pings   []Ping
+}
+
+// memSecret is a rotated token string still accepted until expires.
+type memSecret struct {
+	tokenID int
+	secret  string
+	expires time.Time
+}
+
+func NewMemModel() *MemModel {
+	return &MemModel{
+		tokens: defaultTokenGenerator,
+		byID:   map[int]*memToken{},
+	}
+}
+
+// SetTokenGenerator changes how new token strings are generated.
+func (m *MemModel) SetTokenGenerator(g TokenGenerator) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = g
+	return nil
+}
+
+func (m *MemModel) CreateToken(name, description string, interval int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, err := m.newTokenID()
+	if err != nil {
+		return "", err
+	}
+	m.nextID++
+	m.byID[m.nextID] = &memToken{Token: Token{
+		ID:          m.nextID,
+		Token:       token,
+		Name:        name,
+		Description: description,
+		Interval:    interval,
+		Disabled:    true,
+		Fired:       true,
+		TimeCreated: time.Now().UTC(),
+		Rule:        Rule{Mode: ModeHeartbeat},
+	}}
+	return token, nil
+}
+
+func (m *MemModel) ImportToken(t *Token) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, mt := range m.byID {
+		if mt.Token.Token == t.Token {
+			mt.Name = t.Name
+			mt.Description = t.Description
+			mt.Interval = t.Interval
+			mt.Disabled = t.Disabled
+			mt.deleted = false
+			return id, nil
+		}
+	}
+	if m.tokenInUse(t.Token) {
+		return 0, errTokenInUse
+	}
+
+	m.nextID++
+	m.byID[m.nextID] = &memToken{Token: Token{
+		ID:          m.nextID,
+		Token:       t.Token,
+		Name:        t.Name,
+		Description: t.Description,
+		Interval:    t.Interval,
+		Disabled:    t.Disabled,
+		Fired:       true,
+		TimeCreated: time.Now().UTC(),
+		Rule:        Rule{Mode: ModeHeartbeat},
+	}}
+	return m.nextID, nil
+}
+
+func (m *MemModel) GetTokens() (ListTokens, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list ListTokens
+	for _, t := range m.byID {
+		if !t.deleted {
+			list = append(list, t.copy())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].TimeCreated.Equal(list[j].TimeCreated) {
+			return list[i].ID > list[j].ID
+		}
+		return list[i].TimeCreated.After(list[j].TimeCreated)
+	})
+	return list, nil
+}
+
+func (m *MemModel) GetToken(id int) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok || t.deleted {
+		return nil, nil
+	}
+	return t.copy(), nil
+}
+
+func (m *MemModel) UpdateToken(id int, u TokenUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok || t.deleted {
+		return errNoSuchToken
+	}
+	var list ListTokens
+	for _, lt := range m.byID {
+		if !lt.deleted {
+			list = append(list, &lt.Token)
+		}
+	}
+	err := checkDependency(list, id, u.DependsOn)
+	if err != nil {
+		return err
+	}
+
+	t.Name = u.Name
+	t.Description = u.Description
+	t.Interval = u.Interval
+	t.Tags = append([]string(nil), u.Tags...)
+	sort.Strings(t.Tags)
+	t.Rule = u.Rule
+	t.DependsOn = u.DependsOn
+	return nil
+}
+
+func (m *MemModel) GetIdFromToken(token string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.idFromToken(token, time.Now()), nil
+}
+
+func (m *MemModel) InsertHeartBeat(id int, p Ping) error {
+	return m.InsertHeartBeats([]HeartBeat{{TokenID: id, Ping: p}})
+}
+
+func (m *MemModel) InsertHeartBeats(hbs []HeartBeat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hb := range hbs {
+		p := hb.Ping
+		if p.Time.IsZero() {
+			p.Time = time.Now()
+		}
+		p.Time = p.Time.UTC()
+		if p.Status == "" {
+			p.Status = PingOK
+		}
+		if t, ok := m.byID[hb.TokenID]; ok {
+			t.pings = append(t.pings, p)
+		}
+	}
+	return nil
+}
+
+func (m *MemModel) LastPing(id int) (*Ping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok {
+		return nil, nil
+	}
+	var last *Ping
+	for i := range t.pings {
+		p := t.pings[i]
+		if p.Status == PingStart {
+			continue
+		}
+		if last == nil || !p.Time.Before(last.Time) {
+			last = &p
+		}
+	}
+	return last, nil
+}
+
+func (m *MemModel) GetPings(id int, limit int) ([]Ping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok {
+		return nil, nil
+	}
+	pings := append([]Ping(nil), t.pings...)
+	// Newest first; pings at the same time in reverse arrival order
+	sort.SliceStable(pings, func(i, j int) bool { return pings[i].Time.Before(pings[j].Time) })
+	for i, j := 0, len(pings)-1; i < j; i, j = i+1, j-1 {
+		pings[i], pings[j] = pings[j], pings[i]
+	}
+	if len(pings) > limit {
+		pings = pings[:limit]
+	}
+	return pings, nil
+}
+
+func (m *MemModel) LastValues(id int, n int) ([]float64, error) {
+	pings, err := m.GetPings(id, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	var values []float64
+	for _, p := range pings {
+		if p.Value != nil && len(values) < n {
+			values = append(values, *p.Value)
+		}
+	}
+	return values, nil
+}
+
+func (m *MemModel) CountPings(id int, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok {
+		return 0, nil
+	}
+	var n int
+	for _, p := range t.pings {
+		if p.Status != PingStart && !p.Time.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemModel) Fire(id int, b bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.Fired = b
+	}
+	return nil
+}
+
+func (m *MemModel) Block(id int, b bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.Blocked = b
+	}
+	return nil
+}
+
+func (m *MemModel) Disable(id int, b bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.Disabled = b
+	}
+	return nil
+}
+
+func (m *MemModel) Remove(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.deleted = true
+	}
+	for _, t := range m.byID {
+		if t.DependsOn == id {
+			t.DependsOn = 0
+			t.Blocked = false
+		}
+	}
+	return nil
+}
+
+func (m *MemModel) SetTags(id int, tags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.Tags = append([]string(nil), tags...)
+		sort.Strings(t.Tags)
+	}
+	return nil
+}
+
+func (m *MemModel) SetRule(id int, r Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.byID[id]; ok {
+		t.Rule = r
+	}
+	return nil
+}
+
+func (m *MemModel) RotateToken(id int, overlap time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.byID[id]
+	if !ok || t.deleted {
+		return "", errNoSuchToken
+	}
+
+	now := time.Now()
+	var secrets []memSecret
+	for _, s := range m.secrets {
+		if s.expires.After(now) {
+			secrets = append(secrets, s)
+		}
+	}
+	if overlap > 0 {
+		secrets = append(secrets, memSecret{id, t.Token.Token, now.Add(overlap)})
+	}
+	m.secrets = secrets
+
+	token, err := m.newTokenID()
+	if err != nil {
+		return "", err
+	}
+	t.Token.Token = token
+	return token, nil
+}
+
+// idFromToken must be called with the lock held.
+func (m *MemModel) idFromToken(token string, now time.Time) int {
+	for id, t := range m.byID {
+		if t.Token.Token == token && !t.deleted {
+			return id
+		}
+	}
+	for _, s := range m.secrets {
+		if s.secret == token && s.expires.After(now) && !m.byID[s.tokenID].deleted {
+			return s.tokenID
+		}
+	}
+	return 0
+}
+
+// newTokenID must be called with the lock held.
+func (m *MemModel) newTokenID() (string, error) {
+	for i := 0; i < maxTokenAttempts; i++ {
+		token, err := m.tokens.Generate()
+		if err != nil {
+			return "", err
+		}
+		if !m.tokenInUse(token) {
+			return token, nil
+		}
+	}
+	return "", errTokenInUse
+}
+
+// tokenInUse must be called with the lock held.
+func (m *MemModel) tokenInUse(token string) bool {
+	for _, t := range m.byID {
+		if t.Token.Token == token {
+			return true
+		}
+	}
+	for _, s := range m.secrets {
+		if s.secret == token {
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a snapshot of the token that is safe to hand out.
+func (t *memToken) copy() *Token {
+	c := t.Token
+	c.Tags = append([]string(nil), t.Tags...)
+	return &c
+}
+
+func (m *MemModel) InsertOrphanPing(p OrphanPing) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	p.Time = p.Time.UTC()
+	p.DeletedName = ""
+	m.orphans = append(m.orphans, p)
+	if len(m.orphans) > maxOrphanPings {
+		m.orphans = append(m.orphans[:0], m.orphans[len(m.orphans)-maxOrphanPings:]...)
+	}
+	return nil
+}
+
+func (m *MemModel) GetOrphanPings(limit int) ([]OrphanPing, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []OrphanPing
+	for i := len(m.orphans) - 1; i >= 0 && len(list) < limit; i-- {
+		p := m.orphans[i]
+		for _, t := range m.byID {
+			if t.deleted && t.Token.Token == p.Token {
+				p.DeletedName = t.Name
+			}
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a single schema change. Migrations are applied in order, each
+// one in its own transaction, and never edited once released: add a new one
+// instead.
+type migration struct {
+	version int
+	name    string
+	up      func(tx sqlTx) error
+}
+
+// migrations is the ordered list of schema changes. The first ones use IF NOT
+// EXISTS because they also run against databases created before versioning
+// existed. Schema statements are written for SQLite and adapted to postgres
+// by dialect.ddl.
+var migrations = []migration{
+	{1, "create tokens and pings", execSQL(`
+		CREATE TABLE IF NOT EXISTS tokens (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			token VARCHAR(255) NOT NULL,
+      interval INTEGER,
+			description VARCHAR(1000) NOT NULL,
+
+      -- to disable the token temporarely
+      disabled BOOLEAN NOT NULL DEFAULT TRUE,
+      -- to indicate a token is in a fired state; will go back to false once we get a valid ping again
+      fired BOOLEAN NOT NULL DEFAULT TRUE,
+
+			time_created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  time_deleted TIMESTAMP
+		);
+		
+		CREATE TABLE IF NOT EXISTS pings (
+			id INTEGER NOT NULL PRIMARY KEY,
+			token_id INTEGER NOT NULL REFERENCES tokens(id),
+			last_heartbeat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		
+		CREATE INDEX IF NOT EXISTS tokens_list_id ON pings(token_id);
+		`)},
+	{2, "add tags", execSQL(`
+		CREATE TABLE IF NOT EXISTS tags (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL UNIQUE
+		);
+
+		CREATE TABLE IF NOT EXISTS token_tags (
+			token_id INTEGER NOT NULL REFERENCES tokens(id),
+			tag_id INTEGER NOT NULL REFERENCES tags(id),
+			PRIMARY KEY (token_id, tag_id)
+		);
+		`)},
+	{3, "add token secrets", execSQL(`
+		-- previous token strings that are still accepted after a rotation
+		CREATE TABLE IF NOT EXISTS token_secrets (
+			id INTEGER NOT NULL PRIMARY KEY,
+			token_id INTEGER NOT NULL REFERENCES tokens(id),
+			secret VARCHAR(255) NOT NULL,
+			time_created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			time_expires TIMESTAMP NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS token_secrets_secret ON token_secrets(secret);
+		`)},
+	{4, "make token strings unique", execSQL(`
+		CREATE UNIQUE INDEX IF NOT EXISTS tokens_token ON tokens(token);
+		`)},
+	{5, "add ping status and run details", execSQL(`
+		-- ok, start or fail; see the Ping* constants
+		ALTER TABLE pings ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'ok';
+		ALTER TABLE pings ADD COLUMN exit_code INTEGER;
+		ALTER TABLE pings ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE pings ADD COLUMN output TEXT NOT NULL DEFAULT '';
+		`)},
+	{6, "add orphan pings", execSQL(`
+		-- heartbeats for token strings that match no live token
+		CREATE TABLE IF NOT EXISTS orphan_pings (
+			id INTEGER NOT NULL PRIMARY KEY,
+			token VARCHAR(255) NOT NULL,
+			time_received TIMESTAMP NOT NULL,
+			remote_addr VARCHAR(255) NOT NULL,
+			user_agent VARCHAR(1000) NOT NULL
+		);
+		`)},
+	{7, "add ping sources", execSQL(`
+		ALTER TABLE pings ADD COLUMN remote_addr VARCHAR(255) NOT NULL DEFAULT '';
+		ALTER TABLE pings ADD COLUMN user_agent VARCHAR(1000) NOT NULL DEFAULT '';
+		ALTER TABLE pings ADD COLUMN method VARCHAR(16) NOT NULL DEFAULT '';
+		-- sent by the client to tell hosts and runs apart
+		ALTER TABLE pings ADD COLUMN host VARCHAR(255) NOT NULL DEFAULT '';
+		ALTER TABLE pings ADD COLUMN run_id VARCHAR(255) NOT NULL DEFAULT '';
+		`)},
+	{8, "add token modes", execSQL(`
+		-- heartbeat or inverse; see the Mode* constants
+		ALTER TABLE tokens ADD COLUMN mode VARCHAR(16) NOT NULL DEFAULT 'heartbeat';
+		`)},
+	{9, "add token ping counts", execSQL(`
+		-- number of pings expected per interval by the min_count and max_count modes
+		ALTER TABLE tokens ADD COLUMN ping_count INTEGER NOT NULL DEFAULT 0;
+		`)},
+	{10, "add ping values and thresholds", execSQL(`
+		-- a measurement sent with the ping, like the size of a backup
+		ALTER TABLE pings ADD COLUMN value DOUBLE PRECISION;
+		ALTER TABLE pings ADD COLUMN unit VARCHAR(32) NOT NULL DEFAULT '';
+		-- fire when the last value is below min_value or more than
+		-- max_deviation percent away from the average of the previous ones
+		ALTER TABLE tokens ADD COLUMN min_value DOUBLE PRECISION;
+		ALTER TABLE tokens ADD COLUMN max_deviation DOUBLE PRECISION NOT NULL DEFAULT 0;
+		`)},
+	{11, "add token dependencies", execSQL(`
+		-- the token is blocked, instead of fired, while the one it depends on is fired
+		ALTER TABLE tokens ADD COLUMN depends_on INTEGER REFERENCES tokens(id);
+		ALTER TABLE tokens ADD COLUMN blocked BOOLEAN NOT NULL DEFAULT FALSE;
+		`)},
+}
+
+func execSQL(query string) func(tx sqlTx) error {
+	return func(tx sqlTx) error {
+		_, err := tx.Exec(tx.d.ddl(query))
+		return err
+	}
+}
+
+// migrate brings the schema up to date and returns the migrations that were
+// pending. With dryRun it only reports them, without writing to the database.
+func migrate(db sqlDB, dryRun bool) ([]migration, error) {
+	if !dryRun {
+		_, err := db.Exec(db.d.ddl(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			time_applied TIMESTAMP NOT NULL
+		)`))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, mig := range migrations {
+		if mig.version > current {
+			pending = append(pending, mig)
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+
+	for _, mig := range pending {
+		err = applyMigration(db, mig)
+		if err != nil {
+			return pending, fmt.Errorf("migration %d (%s): %w", mig.version, mig.name, err)
+		}
+	}
+	return pending, nil
+}
+
+func applyMigration(db sqlDB, mig migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = mig.up(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, time_applied) VALUES (?, ?, ?)",
+		mig.version, mig.name, tx.d.ts(time.Now()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion returns the version of the last applied migration, 0 if none
+// or if there is no schema_version table yet.
+func schemaVersion(db sqlDB) (int, error) {
+	exists, err := db.hasTable("schema_version")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// modelFactory returns a new, empty model.
+type modelFactory func(t *testing.T) Model
+
+func TestMemModel(t *testing.T) {
+	testModel(t, func(t *testing.T) Model { return NewMemModel() })
+}
+
+func TestSQLiteModel(t *testing.T) {
+	testModel(t, newSQLiteTestModel)
+}
+
+// TestPostgresModel runs against the database in KAE_TEST_POSTGRES_URL or,
+// if unset, an ephemeral cluster started with the postgres binaries in PATH.
+// It is skipped when neither is available, unless KAE_TEST_PG is set.
+func TestPostgresModel(t *testing.T) {
+	testModel(t, newPostgresTestModel)
+}
+
+// testModel is the conformance suite every Model implementation must pass.
+func testModel(t *testing.T, newModel modelFactory) {
+	t.Run("CreateAndGet", func(t *testing.T) {
+		m := newModel(t)
+		first := mustCreateToken(t, m, "first", "the first token", 10)
+		second := mustCreateToken(t, m, "second", "the second token", 20)
+		if first == second {
+			t.Fatalf("two tokens share the token string %q", first)
+		}
+
+		list, err := m.GetTokens()
+		if err != nil {
+			t.Fatalf("getting tokens: %v", err)
+		}
+		ensureInt(t, len(list), 2)
+		// Most recent first, disabled and fired until told otherwise
+		ensureString(t, list[0].Name, "second")
+		ensureString(t, list[0].Token, second)
+		ensureInt(t, list[0].Interval, 20)
+		ensureString(t, list[0].Description, "the second token")
+		ensureBool(t, list[0].Disabled, true)
+		ensureBool(t, list[0].Fired, true)
+		ensureString(t, list[1].Name, "first")
+		if time.Since(list[0].TimeCreated) > time.Minute {
+			t.Fatalf("unexpected creation time %v", list[0].TimeCreated)
+		}
+
+		id := mustGetId(t, m, first)
+		tk, err := m.GetToken(id)
+		if err != nil {
+			t.Fatalf("getting token: %v", err)
+		}
+		ensureString(t, tk.Name, "first")
+		ensureString(t, tk.Token, first)
+
+		ensureInt(t, mustGetId(t, m, "not-a-token"), 0)
+		tk, err = m.GetToken(id + 1000)
+		if err != nil {
+			t.Fatalf("getting missing token: %v", err)
+		}
+		if tk != nil {
+			t.Fatalf("got token %+v for a missing id", tk)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		m := newModel(t)
+		gateway := mustGetId(t, m, mustCreateToken(t, m, "gateway", "desc", 10))
+		uploadToken := mustCreateToken(t, m, "upload", "desc", 10)
+		upload := mustGetId(t, m, uploadToken)
+
+		minValue := 1.5
+		u := TokenUpdate{
+			Name:        "s3 upload",
+			Description: "new desc",
+			Interval:    30,
+			Tags:        []string{"s3", "backup"},
+			Rule:        Rule{Mode: ModeMinCount, Count: 2, MinValue: &minValue},
+			DependsOn:   gateway,
+		}
+		ensureNoError(t, m.UpdateToken(upload, u))
+		tk, err := m.GetToken(upload)
+		ensureNoError(t, err)
+		ensureString(t, tk.Token, uploadToken)
+		ensureString(t, tk.Name, "s3 upload")
+		ensureString(t, tk.Description, "new desc")
+		ensureInt(t, tk.Interval, 30)
+		ensureString(t, strings.Join(tk.Tags, ","), "backup,s3")
+		ensureBool(t, tk.Rule.equal(u.Rule), true)
+		ensureInt(t, tk.DependsOn, gateway)
+
+		// A wrong dependency leaves the token as it was
+		u.Name = "renamed"
+		u.DependsOn = upload
+		if err := m.UpdateToken(upload, u); err != errDependencyCycle {
+			t.Fatalf("got err %v, want %v", err, errDependencyCycle)
+		}
+		u.DependsOn = gateway + upload
+		if err := m.UpdateToken(upload, u); err != errNoSuchDependency {
+			t.Fatalf("got err %v, want %v", err, errNoSuchDependency)
+		}
+		u.DependsOn = 0
+		if err := m.UpdateToken(gateway+upload, u); err != errNoSuchToken {
+			t.Fatalf("got err %v, want %v", err, errNoSuchToken)
+		}
+		tk, err = m.GetToken(upload)
+		ensureNoError(t, err)
+		ensureString(t, tk.Name, "s3 upload")
+		ensureInt(t, tk.DependsOn, gateway)
+
+		// Concurrent edits cannot make a cycle. Either may fail to commit.
+		mustSetDependency(t, m, upload, 0)
+		var wg sync.WaitGroup
+		for _, e := range [][2]int{{gateway, upload}, {upload, gateway}} {
+			wg.Add(1)
+			go func(id, dependsOn int) {
+				defer wg.Done()
+				m.UpdateToken(id, TokenUpdate{Name: "name", Interval: 10, Rule: Rule{Mode: ModeHeartbeat}, DependsOn: dependsOn})
+			}(e[0], e[1])
+		}
+		wg.Wait()
+		tk, err = m.GetToken(gateway)
+		ensureNoError(t, err)
+		other, err := m.GetToken(upload)
+		ensureNoError(t, err)
+		if tk.DependsOn == upload && other.DependsOn == gateway {
+			t.Fatalf("concurrent edits made a cycle")
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+		other := mustGetId(t, m, mustCreateToken(t, m, "other", "desc", 10))
+
+		ensureNoError(t, m.SetTags(id, []string{"web", "db"}))
+		ensureNoError(t, m.SetTags(other, []string{"db"}))
+		tk, err := m.GetToken(id)
+		ensureNoError(t, err)
+		ensureString(t, strings.Join(tk.Tags, ","), "db,web")
+
+		ensureNoError(t, m.SetTags(id, []string{"cron"}))
+		tk, err = m.GetToken(id)
+		ensureNoError(t, err)
+		ensureString(t, strings.Join(tk.Tags, ","), "cron")
+		tk, err = m.GetToken(other)
+		ensureNoError(t, err)
+		ensureString(t, strings.Join(tk.Tags, ","), "db")
+
+		ensureNoError(t, m.SetTags(id, nil))
+		tk, err = m.GetToken(id)
+		ensureNoError(t, err)
+		ensureInt(t, len(tk.Tags), 0)
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+		other := mustGetId(t, m, mustCreateToken(t, m, "other", "desc", 10))
+
+		tk, err := m.GetToken(id)
+		ensureNoError(t, err)
+		ensureString(t, tk.Rule.Mode, ModeHeartbeat)
+
+		ensureNoError(t, m.SetRule(id, Rule{Mode: ModeInverse}))
+		list, err := m.GetTokens()
+		ensureNoError(t, err)
+		for _, tk := range list {
+			want := ModeHeartbeat
+			if tk.ID == id {
+				want = ModeInverse
+			}
+			ensureString(t, tk.Rule.Mode, want)
+		}
+		tk, err = m.GetToken(other)
+		ensureNoError(t, err)
+		ensureString(t, tk.Rule.Mode, ModeHeartbeat)
+
+		ensureNoError(t, m.SetRule(other, Rule{Mode: ModeMinCount, Count: 5}))
+		tk, err = m.GetToken(other)
+		ensureNoError(t, err)
+		ensureString(t, tk.Rule.Mode, ModeMinCount)
+		ensureInt(t, tk.Rule.Count, 5)
+		if tk.Rule.MinValue != nil {
+			t.Fatalf("got min value %v, want none", *tk.Rule.MinValue)
+		}
+
+		minValue := 1000.5
+		rule := Rule{Mode: ModeHeartbeat, MinValue: &minValue, MaxDeviation: 50}
+		ensureNoError(t, m.SetRule(id, rule))
+		tk, err = m.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Rule.equal(rule), true)
+	})
+
+	t.Run("Values", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+
+		values, err := m.LastValues(id, 5)
+		ensureNoError(t, err)
+		ensureInt(t, len(values), 0)
+
+		now := time.Now()
+		for i, v := range []float64{10, 20.5, 30} {
+			v := v
+			ensureNoError(t, m.InsertHeartBeat(id, Ping{Time: now.Add(time.Duration(i) * time.Second), Value: &v, Unit: "rows"}))
+		}
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{Time: now.Add(5 * time.Second)}))
+		values, err = m.LastValues(id, 2)
+		ensureNoError(t, err)
+		ensureInt(t, len(values), 2)
+		if values[0] != 30 || values[1] != 20.5 {
+			t.Fatalf("got values %v, want [30 20.5]", values)
+		}
+
+		pings, err := m.GetPings(id, 2)
+		ensureNoError(t, err)
+		if pings[0].Value != nil || pings[1].Value == nil || *pings[1].Value != 30 {
+			t.Fatalf("values not stored with their pings: %+v", pings)
+		}
+		ensureString(t, pings[1].Unit, "rows")
+	})
+
+	t.Run("Dependencies", func(t *testing.T) {
+		m := newModel(t)
+		gateway := mustGetId(t, m, mustCreateToken(t, m, "gateway", "desc", 10))
+		upload := mustGetId(t, m, mustCreateToken(t, m, "upload", "desc", 10))
+
+		mustSetDependency(t, m, upload, gateway)
+		ensureNoError(t, m.Disable(upload, false))
+		ensureNoError(t, m.Block(upload, true))
+		tk, err := m.GetToken(upload)
+		ensureNoError(t, err)
+		ensureInt(t, tk.DependsOn, gateway)
+		ensureBool(t, tk.Blocked, true)
+		ensureString(t, tk.State(), "blocked")
+
+		mustSetDependency(t, m, upload, 0)
+		ensureNoError(t, m.Block(upload, false))
+		list, err := m.GetTokens()
+		ensureNoError(t, err)
+		for _, tk := range list {
+			ensureInt(t, tk.DependsOn, 0)
+			ensureBool(t, tk.Blocked, false)
+		}
+	})
+
+	t.Run("CountPings", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+		other := mustGetId(t, m, mustCreateToken(t, m, "other", "desc", 10))
+
+		now := time.Now()
+		ensureNoError(t, m.InsertHeartBeats([]HeartBeat{
+			{TokenID: id, Ping: Ping{Time: now.Add(-2 * time.Hour)}},
+			{TokenID: id, Ping: Ping{Time: now.Add(-30 * time.Minute), Status: PingStart}},
+			{TokenID: id, Ping: Ping{Time: now.Add(-30 * time.Minute)}},
+			{TokenID: id, Ping: Ping{Time: now.Add(-time.Minute), Status: PingFail}},
+			{TokenID: other, Ping: Ping{Time: now}},
+		}))
+		n, err := m.CountPings(id, now.Add(-time.Hour))
+		ensureNoError(t, err)
+		ensureInt(t, n, 2)
+		n, err = m.CountPings(id, now.Add(-3*time.Hour))
+		ensureNoError(t, err)
+		ensureInt(t, n, 3)
+		n, err = m.CountPings(id, now)
+		ensureNoError(t, err)
+		ensureInt(t, n, 0)
+	})
+
+	t.Run("DisableAndFire", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+
+		ensureNoError(t, m.Disable(id, false))
+		ensureNoError(t, m.Fire(id, false))
+		tk, err := m.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Disabled, false)
+		ensureBool(t, tk.Fired, false)
+
+		ensureNoError(t, m.Disable(id, true))
+		ensureNoError(t, m.Fire(id, true))
+		tk, err = m.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Disabled, true)
+		ensureBool(t, tk.Fired, true)
+	})
+
+	t.Run("HeartBeats", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+
+		last, err := m.LastPing(id)
+		ensureNoError(t, err)
+		if last != nil {
+			t.Fatalf("got last heartbeat %v before any ping", last.Time)
+		}
+
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{}))
+		last, err = m.LastPing(id)
+		ensureNoError(t, err)
+		if d := time.Since(last.Time); d < -time.Minute || d > time.Minute {
+			t.Fatalf("last heartbeat %v is not close to now", last.Time)
+		}
+		ensureString(t, last.Status, PingOK)
+
+		// Start pings do not count as heartbeats
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{Status: PingStart, Time: time.Now().Add(time.Second)}))
+		code := 3
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{
+			Status:   PingFail,
+			Time:     time.Now().Add(2 * time.Second),
+			ExitCode: &code,
+			Duration: 1500 * time.Millisecond,
+			Output:   "disk full\n",
+		}))
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{Status: PingStart, Time: time.Now().Add(3 * time.Second)}))
+		last, err = m.LastPing(id)
+		ensureNoError(t, err)
+		ensureString(t, last.Status, PingFail)
+		if last.ExitCode == nil || *last.ExitCode != 3 {
+			t.Fatalf("got exit code %v, want 3", last.ExitCode)
+		}
+		if last.Duration != 1500*time.Millisecond {
+			t.Fatalf("got duration %v, want 1.5s", last.Duration)
+		}
+		ensureString(t, last.Output, "disk full\n")
+
+		ensureNoError(t, m.InsertHeartBeat(id, Ping{
+			Time:       time.Now().Add(4 * time.Second),
+			RemoteAddr: "10.0.0.1",
+			UserAgent:  "curl/8.0",
+			Method:     "GET",
+			Host:       "db1",
+			RunID:      "run-1",
+		}))
+		pings, err := m.GetPings(id, 10)
+		ensureNoError(t, err)
+		ensureInt(t, len(pings), 5)
+		for i, want := range []string{PingOK, PingStart, PingFail, PingStart, PingOK} {
+			ensureString(t, pings[i].Status, want)
+		}
+		p := pings[0]
+		for _, f := range [][2]string{
+			{p.RemoteAddr, "10.0.0.1"}, {p.UserAgent, "curl/8.0"}, {p.Method, "GET"}, {p.Host, "db1"}, {p.RunID, "run-1"},
+		} {
+			ensureString(t, f[0], f[1])
+		}
+		pings, err = m.GetPings(id, 2)
+		ensureNoError(t, err)
+		ensureInt(t, len(pings), 2)
+	})
+
+	t.Run("BatchHeartBeats", func(t *testing.T) {
+		m := newModel(t)
+		a := mustGetId(t, m, mustCreateToken(t, m, "a", "desc", 10))
+		b := mustGetId(t, m, mustCreateToken(t, m, "b", "desc", 10))
+
+		now := time.Now()
+		ensureNoError(t, m.InsertHeartBeats(nil))
+		ensureNoError(t, m.InsertHeartBeats([]HeartBeat{
+			{TokenID: a, Ping: Ping{Time: now.Add(-time.Minute), Status: PingStart}},
+			{TokenID: b, Ping: Ping{Time: now, Host: "db1"}},
+			{TokenID: a, Ping: Ping{Time: now, Status: PingFail}},
+		}))
+
+		pings, err := m.GetPings(a, 10)
+		ensureNoError(t, err)
+		ensureInt(t, len(pings), 2)
+		ensureString(t, pings[0].Status, PingFail)
+		ensureString(t, pings[1].Status, PingStart)
+		last, err := m.LastPing(b)
+		ensureNoError(t, err)
+		ensureString(t, last.Status, PingOK)
+		ensureString(t, last.Host, "db1")
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		m := newModel(t)
+		old := mustCreateToken(t, m, "name", "desc", 10)
+		id := mustGetId(t, m, old)
+
+		rotated, err := m.RotateToken(id, time.Hour)
+		ensureNoError(t, err)
+		if rotated == old {
+			t.Fatalf("token string did not change after rotation")
+		}
+		ensureInt(t, mustGetId(t, m, old), id)
+		ensureInt(t, mustGetId(t, m, rotated), id)
+
+		latest, err := m.RotateToken(id, 0)
+		ensureNoError(t, err)
+		ensureInt(t, mustGetId(t, m, old), id)
+		ensureInt(t, mustGetId(t, m, rotated), 0)
+		ensureInt(t, mustGetId(t, m, latest), id)
+
+		_, err = m.RotateToken(id+1000, time.Hour)
+		if err != errNoSuchToken {
+			t.Fatalf("got err %v rotating a missing token, want %v", err, errNoSuchToken)
+		}
+	})
+
+	t.Run("ImportToken", func(t *testing.T) {
+		m := newModel(t)
+		id, err := m.ImportToken(&Token{
+			Token: "imported-token", Name: "name", Description: "desc", Interval: 10,
+		})
+		ensureNoError(t, err)
+		ensureInt(t, mustGetId(t, m, "imported-token"), id)
+		tk, err := m.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Disabled, false)
+
+		// Same token string updates the token, even if it had been deleted
+		ensureNoError(t, m.Remove(id))
+		again, err := m.ImportToken(&Token{
+			Token: "imported-token", Name: "renamed", Description: "desc", Interval: 20, Disabled: true,
+		})
+		ensureNoError(t, err)
+		ensureInt(t, again, id)
+		tk, err = m.GetToken(id)
+		ensureNoError(t, err)
+		ensureString(t, tk.Name, "renamed")
+		ensureInt(t, tk.Interval, 20)
+		ensureBool(t, tk.Disabled, true)
+
+		// Token strings still accepted after a rotation cannot be taken
+		rotated := mustCreateToken(t, m, "rotated", "desc", 10)
+		_, err = m.RotateToken(mustGetId(t, m, rotated), time.Hour)
+		ensureNoError(t, err)
+		_, err = m.ImportToken(&Token{Token: rotated, Name: "n", Description: "d", Interval: 1})
+		if err != errTokenInUse {
+			t.Fatalf("got err %v importing a rotated token string, want %v", err, errTokenInUse)
+		}
+	})
+
+	t.Run("Concurrency", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 40)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := m.CreateToken("concurrent", "desc", 10)
+				errs <- err
+				errs <- m.InsertHeartBeat(id, Ping{})
+				_, err = m.GetTokens()
+				errs <- err
+				errs <- m.Fire(id, false)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			ensureNoError(t, err)
+		}
+
+		list, err := m.GetTokens()
+		ensureNoError(t, err)
+		ensureInt(t, len(list), 11)
+		seen := map[string]bool{}
+		for _, tk := range list {
+			if seen[tk.Token] {
+				t.Fatalf("token string %q used twice", tk.Token)
+			}
+			seen[tk.Token] = true
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		m := newModel(t)
+		id := mustGetId(t, m, mustCreateToken(t, m, "name", "desc", 10))
+		mustCreateToken(t, m, "other", "desc", 10)
+
+		ensureNoError(t, m.Remove(id))
+		list, err := m.GetTokens()
+		ensureNoError(t, err)
+		ensureInt(t, len(list), 1)
+		ensureString(t, list[0].Name, "other")
+		tk, err := m.GetToken(id)
+		ensureNoError(t, err)
+		if tk != nil {
+			t.Fatalf("got removed token %+v", tk)
+		}
+
+		// Neither the token string nor rotated ones match a removed token
+		old := mustCreateToken(t, m, "rotated", "desc", 10)
+		rotatedID := mustGetId(t, m, old)
+		current, err := m.RotateToken(rotatedID, time.Hour)
+		ensureNoError(t, err)
+		ensureNoError(t, m.Remove(rotatedID))
+		ensureInt(t, mustGetId(t, m, old), 0)
+		ensureInt(t, mustGetId(t, m, current), 0)
+
+		// Tokens depending on a removed one depend on none
+		gateway := mustGetId(t, m, mustCreateToken(t, m, "gateway", "desc", 10))
+		upload := mustGetId(t, m, mustCreateToken(t, m, "upload", "desc", 10))
+		mustSetDependency(t, m, upload, gateway)
+		ensureNoError(t, m.Block(upload, true))
+		ensureNoError(t, m.Remove(gateway))
+		tk, err = m.GetToken(upload)
+		ensureNoError(t, err)
+		ensureInt(t, tk.DependsOn, 0)
+		ensureBool(t, tk.Blocked, false)
+	})
+
+	t.Run("OrphanPings", func(t *testing.T) {
+		m := newModel(t)
+		token := mustCreateToken(t, m, "deleted", "desc", 10)
+		ensureNoError(t, m.Remove(mustGetId(t, m, token)))
+
+		ensureNoError(t, m.InsertOrphanPing(OrphanPing{Token: "typo", RemoteAddr: "10.0.0.1:1234", UserAgent: "curl/8.0"}))
+		ensureNoError(t, m.InsertOrphanPing(OrphanPing{Token: token, RemoteAddr: "10.0.0.2:1234"}))
+
+		list, err := m.GetOrphanPings(10)
+		ensureNoError(t, err)
+		ensureInt(t, len(list), 2)
+		ensureString(t, list[0].Token, token)
+		ensureString(t, list[0].DeletedName, "deleted")
+		ensureString(t, list[1].Token, "typo")
+		ensureString(t, list[1].DeletedName, "")
+		ensureString(t, list[1].RemoteAddr, "10.0.0.1:1234")
+		ensureString(t, list[1].UserAgent, "curl/8.0")
+		if d := time.Since(list[1].Time); d < -time.Minute || d > time.Minute {
+			t.Fatalf("orphan ping time %v is not close to now", list[1].Time)
+		}
+
+		list, err = m.GetOrphanPings(1)
+		ensureNoError(t, err)
+		ensureInt(t, len(list), 1)
+	})
+}
+
+func mustCreateToken(t *testing.T, m Model, name, desc string, interval int) string {
+	t.Helper()
+	token, err := m.CreateToken(name, desc, interval)
+	if err != nil {
+		t.Fatalf("creating token: %v", err)
+	}
+	return token
+}
+
+func mustGetId(t *testing.T, m Model, token string) int {
+	t.Helper()
+	id, err := m.GetIdFromToken(token)
+	if err != nil {
+		t.Fatalf("getting id for %q: %v", token, err)
+	}
+	return id
+}
+
+// mustSetDependency makes the token id depend on dependsOn, leaving the rest
+// of its fields alone.
+func mustSetDependency(t *testing.T, m Model, id, dependsOn int) {
+	t.Helper()
+	tk, err := m.GetToken(id)
+	if err != nil {
+		t.Fatalf("getting token %d: %v", id, err)
+	}
+	u := tk.update()
+	u.DependsOn = dependsOn
+	err = m.UpdateToken(id, u)
+	if err != nil {
+		t.Fatalf("setting dependency of %d: %v", id, err)
+	}
+}
+
+// ensureNoError fails the test if err is not nil.
+func ensureNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// ensureBool asserts that got==want for bools.
+func ensureBool(t *testing.T, got, want bool) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("got %t, want %t", got, want)
+	}
+}
+
+func newSQLiteTestModel(t *testing.T) Model {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	// Every connection to :memory: gets its own database, so stick to one.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	model, err := NewSQLModel(db)
+	if err != nil {
+		t.Fatalf("creating model: %v", err)
+	}
+	return model
+}
+
+// postgresURL is the server shared by all the postgres tests, started on
+// first use.
+var postgresURL string
+
+func newPostgresTestModel(t *testing.T) Model {
+	t.Helper()
+	if postgresURL == "" {
+		postgresURL = os.Getenv("KAE_TEST_POSTGRES_URL")
+	}
+	if postgresURL == "" {
+		postgresURL = startPostgres(t)
+	}
+
+	// Each model gets its own schema so tests don't see each other's rows.
+	admin, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		t.Fatalf("opening postgres: %v", err)
+	}
+	defer admin.Close()
+	schema := fmt.Sprintf("kae_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open("postgres", postgresURL)
+		if err == nil {
+			admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			admin.Close()
+		}
+	})
+
+	sep := "?"
+	if strings.Contains(postgresURL, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("postgres", postgresURL+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatalf("opening postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	model, err := NewPostgresModel(db)
+	if err != nil {
+		t.Fatalf("creating model: %v", err)
+	}
+	return model
+}
+
+// startPostgres runs a throwaway postgres cluster for the rest of the test
+// binary and returns its URL. It skips the test if postgres is not installed.
+func startPostgres(t *testing.T) string {
+	t.Helper()
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		skipPostgres(t, "set KAE_TEST_POSTGRES_URL or put the postgres binaries in PATH to run postgres tests")
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		skipPostgres(t, "pg_ctl not found in PATH")
+	}
+
+	dir, err := os.MkdirTemp("", "kae-postgres")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	dataDir := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "kae", "--auth=trust").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		skipPostgres(t, "initdb failed (postgres refuses to run as root): %v\n%s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	out, err = exec.Command(pgCtl, "-D", dataDir, "-o", opts, "-w", "start").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("starting postgres: %v\n%s", err, out)
+	}
+	cleanupPostgres = func() {
+		exec.Command(pgCtl, "-D", dataDir, "-m", "immediate", "stop").Run()
+		os.RemoveAll(dir)
+	}
+	return fmt.Sprintf("postgres://kae@127.0.0.1:%d/postgres?sslmode=disable", port)
+}
+
+// skipPostgres skips a postgres test that cannot run, or fails it when
+// KAE_TEST_PG is set so that CI cannot pass without running it.
+func skipPostgres(t *testing.T, format string, args ...interface{}) {
+	t.Helper()
+	if os.Getenv("KAE_TEST_PG") != "" {
+		t.Fatalf(format, args...)
+	}
+	t.Skipf(format, args...)
+}
+
+// cleanupPostgres stops the cluster started by startPostgres, if any.
+var cleanupPostgres = func() {}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	cleanupPostgres()
+	os.Exit(code)
+}
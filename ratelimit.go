@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of rate limit buckets kept before idle ones are dropped.
+const maxRateBuckets = 10000
+
+// rateLimiter is a token bucket per key allowing perMinute events a minute,
+// in bursts of up to perMinute. A nil rateLimiter allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // events per second
+	burst   float64
+	buckets map[string]*rateBucket
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[string]*rateBucket{},
+		now:     time.Now,
+	}
+}
+
+// allow reports whether one more event for key fits in the limit.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops the buckets that have refilled, which behave like new ones.
+// If they are all in use, say because of a flood of addresses, it drops them
+// all: letting a burst through beats refusing heartbeats or running out of
+// memory. It must be called with the lock held.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) >= maxRateBuckets {
+		l.buckets = map[string]*rateBucket{}
+	}
+}
+
+// retryAfter is how long until a drained bucket allows one more event.
+func (l *rateLimiter) retryAfter() time.Duration {
+	return time.Duration(math.Ceil(1/l.rate)) * time.Second
+}
+
+// coalescer drops pings that repeat the status of the last ping recorded for
+// the same token less than spacing ago. A nil coalescer keeps everything.
+type coalescer struct {
+	mu      sync.Mutex
+	spacing time.Duration
+	last    map[int]Ping
+}
+
+func newCoalescer(spacing time.Duration) *coalescer {
+	if spacing <= 0 {
+		return nil
+	}
+	return &coalescer{spacing: spacing, last: map[int]Ping{}}
+}
+
+// coalesce reports whether p, a ping for t, can be dropped. Otherwise p is
+// remembered as the last ping of the token. Pings carrying a value are
+// measurements and never dropped, and neither are the pings of tokens
+// expecting one at least every spacing, which would look late otherwise.
+func (c *coalescer) coalesce(t *Token, p Ping) bool {
+	if c == nil || time.Duration(t.Interval)*time.Second <= c.spacing {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := t.ID
+	last, ok := c.last[id]
+	if ok && p.Time.Before(last.Time) {
+		// A late, backdated ping. Keep it, and the newer one as the last.
+		return false
+	}
+	if ok && last.Status == p.Status && p.Time.Sub(last.Time) < c.spacing && p.Value == nil {
+		return true
+	}
+	c.last[id] = Ping{Time: p.Time, Status: p.Status}
+	return false
+}
+
+// forget drops the last ping of a token, when it could not be recorded.
+func (c *coalescer) forget(id int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, id)
+}
+
+// hbStats counts what happened to the heartbeats received since startup.
+type hbStats struct {
+	recorded       atomic.Int64
+	coalesced      atomic.Int64
+	orphans        atomic.Int64
+	limitedByToken atomic.Int64
+	limitedByIP    atomic.Int64
+}
+
+// hbStatsJSON is what /admin/hb-stats returns.
+type hbStatsJSON struct {
+	Recorded       int64 `json:"recorded"`
+	Coalesced      int64 `json:"coalesced"`
+	Orphans        int64 `json:"orphans"`
+	LimitedByToken int64 `json:"limited_by_token"`
+	LimitedByIP    int64 `json:"limited_by_ip"`
+}
+
+func (st *hbStats) snapshot() hbStatsJSON {
+	return hbStatsJSON{
+		Recorded:       st.recorded.Load(),
+		Coalesced:      st.coalesced.Load(),
+		Orphans:        st.orphans.Load(),
+		LimitedByToken: st.limitedByToken.Load(),
+		LimitedByIP:    st.limitedByIP.Load(),
+	}
+}
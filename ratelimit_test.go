@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2)
+	l.now = func() time.Time { return now }
+
+	ensureBool(t, l.allow("a"), true)
+	ensureBool(t, l.allow("a"), true)
+	ensureBool(t, l.allow("a"), false)
+	ensureBool(t, l.allow("b"), true)
+	ensureString(t, l.retryAfter().String(), "30s")
+
+	now = now.Add(30 * time.Second)
+	ensureBool(t, l.allow("a"), true)
+	ensureBool(t, l.allow("a"), false)
+
+	// Refilled buckets are dropped when there are too many
+	now = now.Add(time.Hour)
+	for i := 0; i < maxRateBuckets+1; i++ {
+		l.allow(strconv.Itoa(i))
+	}
+	if len(l.buckets) > maxRateBuckets {
+		t.Fatalf("got %d buckets, want at most %d", len(l.buckets), maxRateBuckets)
+	}
+
+	var unlimited *rateLimiter
+	ensureBool(t, unlimited.allow("a"), true)
+}
+
+func TestCoalescer(t *testing.T) {
+	now := time.Now()
+	c := newCoalescer(10 * time.Second)
+	tk1, tk2 := &Token{ID: 1, Interval: 60}, &Token{ID: 2, Interval: 60}
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now, Status: PingOK}), false)
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(time.Second), Status: PingOK}), true)
+	ensureBool(t, c.coalesce(tk2, Ping{Time: now.Add(time.Second), Status: PingOK}), false)
+
+	// A different status is always kept
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(2 * time.Second), Status: PingFail}), false)
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(3 * time.Second), Status: PingOK}), false)
+
+	// So are late pings, pings with a value and pings after the spacing
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(-time.Minute), Status: PingOK}), false)
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(13 * time.Second), Status: PingOK}), false)
+	value := 42.0
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(14 * time.Second), Status: PingOK, Value: &value}), false)
+
+	c.forget(1)
+	ensureBool(t, c.coalesce(tk1, Ping{Time: now.Add(14 * time.Second), Status: PingOK}), false)
+
+	// Tokens expecting pings at least every spacing keep them all
+	short := &Token{ID: 3, Interval: 10}
+	ensureBool(t, c.coalesce(short, Ping{Time: now, Status: PingOK}), false)
+	ensureBool(t, c.coalesce(short, Ping{Time: now.Add(time.Second), Status: PingOK}), false)
+}
+
+func TestHeartBeatLimits(t *testing.T) {
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		tokenRate:      3,
+		ipRate:         5,
+		minPingSpacing: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	token := mustCreateToken(t, server.model, "backup", "db backup", 3600)
+	id := mustGetId(t, server.model, token)
+	hb := func(token, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/hb/"+token, nil)
+		r.RemoteAddr = ip + ":1234"
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	ensureString(t, hb(token, "192.0.2.1").Body.String(), "ok t="+token)
+	ensureString(t, hb(token, "192.0.2.1").Body.String(), "ok t="+token+" (coalesced)")
+	ensureCode(t, hb(token, "192.0.2.2"), http.StatusOK)
+	recorder := hb(token, "192.0.2.2")
+	ensureCode(t, recorder, http.StatusTooManyRequests)
+	ensureString(t, recorder.Header().Get("Retry-After"), "20")
+
+	// Unknown tokens count against the client address
+	for i := 0; i < 3; i++ {
+		ensureCode(t, hb("typo"+strconv.Itoa(i), "192.0.2.1"), http.StatusOK)
+	}
+	ensureCode(t, hb("typo", "192.0.2.1"), http.StatusTooManyRequests)
+
+	pings, err := server.model.GetPings(id, 10)
+	ensureNoError(t, err)
+	ensureInt(t, len(pings), 1)
+
+	recorder = serve(t, server, "GET", "/admin/hb-stats", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	var stats hbStatsJSON
+	err = json.Unmarshal(recorder.Body.Bytes(), &stats)
+	ensureNoError(t, err)
+	ensureInt(t, int(stats.Recorded), 1)
+	ensureInt(t, int(stats.Coalesced), 2)
+	ensureInt(t, int(stats.Orphans), 3)
+	ensureInt(t, int(stats.LimitedByToken), 1)
+	ensureInt(t, int(stats.LimitedByIP), 1)
+}
+
+func TestHeartBeatBatchLimits(t *testing.T) {
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		tokenRate:      2,
+		ipRate:         2,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	a := mustCreateToken(t, server.model, "a", "desc", 3600)
+	b := mustCreateToken(t, server.model, "b", "desc", 3600)
+	batch := func(tokens ...string) *httptest.ResponseRecorder {
+		var in []pingInput
+		for _, token := range tokens {
+			in = append(in, pingInput{Token: token})
+		}
+		body, err := json.Marshal(in)
+		ensureNoError(t, err)
+		r := httptest.NewRequest("POST", "/hb/batch", bytes.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1234"
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	// A batch takes a single heartbeat from the limit of the client address
+	recorder := batch(a, a, b, b, b)
+	ensureCode(t, recorder, http.StatusOK)
+	var results []struct{ Token, Result string }
+	ensureNoError(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	ensureInt(t, len(results), 5)
+	for i, want := range []string{"recorded", "recorded", "recorded", "recorded", "rate_limited"} {
+		ensureString(t, results[i].Result, want)
+	}
+
+	// Batches refused as a whole can be retried later
+	recorder = batch(a, b)
+	ensureCode(t, recorder, http.StatusTooManyRequests)
+	ensureString(t, recorder.Header().Get("Retry-After"), "30")
+	recorder = batch(a)
+	ensureCode(t, recorder, http.StatusTooManyRequests)
+	ensureString(t, recorder.Header().Get("Retry-After"), "30")
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MonitorSpec is a desired token in the monitors file. Monitors are matched
+// to tokens by name.
+type MonitorSpec struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Interval    int      `yaml:"interval"`
+	Tags        []string `yaml:"tags,omitempty"`
+	Disabled    bool     `yaml:"disabled,omitempty"`
+	Mode        string   `yaml:"mode,omitempty"`
+	Count       int      `yaml:"count,omitempty"`
+	// Threshold rules on the values sent with the pings
+	MinValue     *float64 `yaml:"min_value,omitempty"`
+	MaxDeviation float64  `yaml:"max_deviation,omitempty"`
+	// DependsOn is the name of the token this one depends on.
+	DependsOn string `yaml:"depends_on,omitempty"`
+	// Token is only used when the token is created, so it can be moved
+	// without touching the jobs pinging it. It is generated if empty.
+	Token string `yaml:"token,omitempty"`
+}
+
+// MonitorsFile is the declarative description of the tokens kae should have.
+type MonitorsFile struct {
+	// DisableUnmanaged disables the tokens that are not in Monitors.
+	DisableUnmanaged bool          `yaml:"disable_unmanaged"`
+	Monitors         []MonitorSpec `yaml:"monitors"`
+}
+
+// ReconcileResult counts what a reconcile did.
+type ReconcileResult struct {
+	Created   int
+	Updated   int
+	Unchanged int
+	Disabled  int
+}
+
+func (r ReconcileResult) String() string {
+	return fmt.Sprintf("created=%d updated=%d unchanged=%d disabled=%d",
+		r.Created, r.Updated, r.Unchanged, r.Disabled)
+}
+
+func loadMonitorsFile(path string) (MonitorsFile, error) {
+	var mf MonitorsFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return mf, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&mf)
+	if err != nil && err != io.EOF {
+		return mf, fmt.Errorf("%s: %w", path, err)
+	}
+	err = mf.validate()
+	if err != nil {
+		return mf, fmt.Errorf("%s: %w", path, err)
+	}
+	return mf, nil
+}
+
+// validate normalizes and checks every monitor.
+func (mf MonitorsFile) validate() error {
+	seen := map[string]bool{}
+	for i := range mf.Monitors {
+		spec := &mf.Monitors[i]
+		spec.Name = strings.TrimSpace(spec.Name)
+		spec.Description = strings.TrimSpace(spec.Description)
+		spec.Tags = parseTags(strings.Join(spec.Tags, ","))
+		sort.Strings(spec.Tags)
+		spec.Mode = spec.rule().withDefaults().Mode
+
+		err := tokenForm{
+			Name:        spec.Name,
+			Description: spec.Description,
+			Interval:    spec.Interval,
+			Rule:        spec.rule(),
+		}.validate()
+		if err == nil && spec.Token != "" && strings.Trim(spec.Token, urlSafeChars) != "" {
+			err = errors.New("token has characters that are not URL safe")
+		}
+		if err == nil && spec.DependsOn == spec.Name {
+			err = errors.New("a monitor cannot depend on itself")
+		}
+		if err != nil {
+			return fmt.Errorf("monitor %d (%q): %w", i+1, spec.Name, err)
+		}
+		if seen[spec.Name] {
+			return fmt.Errorf("monitor %d (%q): name used more than once", i+1, spec.Name)
+		}
+		seen[spec.Name] = true
+	}
+	return nil
+}
+
+// reconcile makes the tokens match the monitors file: missing tokens are
+// created, changed ones updated and, if asked to, the rest disabled.
+func reconcile(m Model, mf MonitorsFile) (ReconcileResult, error) {
+	var result ReconcileResult
+	list, err := m.GetTokens()
+	if err != nil {
+		return result, err
+	}
+
+	byName := map[string]*Token{}
+	for _, t := range list {
+		if _, ok := byName[t.Name]; ok {
+			if mf.has(t.Name) {
+				return result, fmt.Errorf("monitor %q: more than one token has that name", t.Name)
+			}
+			continue
+		}
+		byName[t.Name] = t
+	}
+
+	unchanged := map[string]bool{}
+	for _, spec := range mf.Monitors {
+		t, ok := byName[spec.Name]
+		if !ok {
+			err = createMonitor(m, spec)
+			if err != nil {
+				return result, fmt.Errorf("creating %q: %w", spec.Name, err)
+			}
+			result.Created++
+			continue
+		}
+
+		if spec.matches(t) {
+			unchanged[spec.Name] = true
+			result.Unchanged++
+			continue
+		}
+		err = updateMonitor(m, t.ID, t.DependsOn, spec)
+		if err != nil {
+			return result, fmt.Errorf("updating %q: %w", spec.Name, err)
+		}
+		result.Updated++
+	}
+
+	err = reconcileDependencies(m, mf, func(name string) {
+		if unchanged[name] {
+			unchanged[name] = false
+			result.Unchanged--
+			result.Updated++
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if mf.DisableUnmanaged {
+		for _, t := range list {
+			if mf.has(t.Name) || t.Disabled {
+				continue
+			}
+			err = m.Disable(t.ID, true)
+			if err != nil {
+				return result, fmt.Errorf("disabling %q: %w", t.Name, err)
+			}
+			result.Disabled++
+		}
+	}
+	return result, nil
+}
+
+// reconcileDependencies sets the dependencies of the monitors once they all
+// exist, calling changed with the name of the monitors it updates.
+func reconcileDependencies(m Model, mf MonitorsFile, changed func(name string)) error {
+	list, err := m.GetTokens()
+	if err != nil {
+		return err
+	}
+	byName := map[string]*Token{}
+	for _, t := range list {
+		if _, ok := byName[t.Name]; ok {
+			// Ambiguous. Monitors never are, reconcile refuses them.
+			byName[t.Name] = nil
+			continue
+		}
+		byName[t.Name] = t
+	}
+
+	for _, spec := range mf.Monitors {
+		var dependsOn int
+		if spec.DependsOn != "" {
+			dep, ok := byName[spec.DependsOn]
+			switch {
+			case !ok:
+				return fmt.Errorf("monitor %q: depends on %q, which does not exist", spec.Name, spec.DependsOn)
+			case dep == nil:
+				return fmt.Errorf("monitor %q: depends on %q, and more than one token has that name", spec.Name, spec.DependsOn)
+			}
+			dependsOn = dep.ID
+		}
+		ok, err := setDependency(m, list, byName[spec.Name].ID, dependsOn)
+		if err != nil {
+			return fmt.Errorf("monitor %q: %w", spec.Name, err)
+		}
+		if ok {
+			changed(spec.Name)
+		}
+	}
+	return nil
+}
+
+func createMonitor(m Model, spec MonitorSpec) error {
+	if spec.Token != "" {
+		id, err := m.ImportToken(&Token{
+			Token:       spec.Token,
+			Name:        spec.Name,
+			Description: spec.Description,
+			Interval:    spec.Interval,
+			Disabled:    spec.Disabled,
+		})
+		if err != nil {
+			return err
+		}
+		return m.UpdateToken(id, spec.update(0))
+	}
+
+	token, err := m.CreateToken(spec.Name, spec.Description, spec.Interval)
+	if err != nil {
+		return err
+	}
+	id, err := m.GetIdFromToken(token)
+	if err != nil {
+		return err
+	}
+	return updateMonitor(m, id, 0, spec)
+}
+
+// updateMonitor makes the token match spec. The dependency is kept as
+// dependsOn, it is set once all the monitors exist.
+func updateMonitor(m Model, id, dependsOn int, spec MonitorSpec) error {
+	err := m.UpdateToken(id, spec.update(dependsOn))
+	if err != nil {
+		return err
+	}
+	return m.Disable(id, spec.Disabled)
+}
+
+func (mf MonitorsFile) has(name string) bool {
+	for _, spec := range mf.Monitors {
+		if spec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec MonitorSpec) matches(t *Token) bool {
+	return spec.Description == t.Description &&
+		spec.Interval == t.Interval &&
+		spec.Disabled == t.Disabled &&
+		strings.Join(spec.Tags, ",") == strings.Join(t.Tags, ",") &&
+		spec.rule().equal(t.Rule)
+}
+
+func (spec MonitorSpec) rule() Rule {
+	return Rule{Mode: spec.Mode, Count: spec.Count, MinValue: spec.MinValue, MaxDeviation: spec.MaxDeviation}
+}
+
+func (spec MonitorSpec) update(dependsOn int) TokenUpdate {
+	return TokenUpdate{
+		Name:        spec.Name,
+		Description: spec.Description,
+		Interval:    spec.Interval,
+		Tags:        spec.Tags,
+		Rule:        spec.rule(),
+		DependsOn:   dependsOn,
+	}
+}
+
+// reconcileFile loads the monitors file and reconciles the tokens with it.
+func reconcileFile(m Model, path string, logger Logger) error {
+	mf, err := loadMonitorsFile(path)
+	if err != nil {
+		return err
+	}
+	result, err := reconcile(m, mf)
+	if err != nil {
+		return err
+	}
+	logger.Printf("reconcile: %s %s", path, result)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	m := NewMemModel()
+	manual := mustCreateToken(t, m, "manual", "created from the UI", 60)
+	ensureNoError(t, m.Disable(mustGetId(t, m, manual), false))
+
+	path := filepath.Join(t.TempDir(), "monitors.yaml")
+	writeMonitors := func(content string) {
+		t.Helper()
+		err := os.WriteFile(path, []byte(content), 0o600)
+		if err != nil {
+			t.Fatalf("writing monitors file: %v", err)
+		}
+	}
+	apply := func() ReconcileResult {
+		t.Helper()
+		mf, err := loadMonitorsFile(path)
+		ensureNoError(t, err)
+		result, err := reconcile(m, mf)
+		ensureNoError(t, err)
+		return result
+	}
+
+	writeMonitors(`
+monitors:
+  - name: backup
+    description: hourly backup
+    interval: 3600
+    tags: [db]
+  - name: certs
+    description: cert renewal
+    interval: 86400
+    token: certs-token
+`)
+	result := apply()
+	ensureInt(t, result.Created, 2)
+	ensureInt(t, mustGetId(t, m, "certs-token"), 3)
+	backup, err := m.GetToken(2)
+	ensureNoError(t, err)
+	ensureString(t, backup.Name, "backup")
+	ensureBool(t, backup.Disabled, false)
+	ensureString(t, backup.Tags[0], "db")
+
+	// Applying the same file again changes nothing
+	result = apply()
+	ensureInt(t, result.Unchanged, 2)
+	ensureInt(t, result.Created+result.Updated+result.Disabled, 0)
+
+	// Changed intervals are updated, the token string is kept and unmanaged
+	// tokens are disabled when asked to
+	writeMonitors(`
+disable_unmanaged: true
+monitors:
+  - name: backup
+    description: hourly backup
+    interval: 7200
+    tags: [db]
+  - name: certs
+    description: cert renewal
+    interval: 86400
+`)
+	result = apply()
+	ensureInt(t, result.Updated, 1)
+	ensureInt(t, result.Unchanged, 1)
+	ensureInt(t, result.Disabled, 1)
+	updated, err := m.GetToken(2)
+	ensureNoError(t, err)
+	ensureInt(t, updated.Interval, 7200)
+	ensureString(t, updated.Token, backup.Token)
+	tk, err := m.GetToken(1)
+	ensureNoError(t, err)
+	ensureBool(t, tk.Disabled, true)
+
+	// Dependencies are set once every monitor exists, and cycles rejected
+	writeMonitors(`
+monitors:
+  - name: backup
+    description: hourly backup
+    interval: 7200
+    tags: [db]
+    depends_on: network
+  - name: certs
+    description: cert renewal
+    interval: 86400
+  - name: network
+    description: gateway
+    interval: 60
+`)
+	result = apply()
+	ensureInt(t, result.Created, 1)
+	ensureInt(t, result.Updated, 1)
+	ensureInt(t, result.Unchanged, 1)
+	updated, err = m.GetToken(2)
+	ensureNoError(t, err)
+	ensureInt(t, updated.DependsOn, 4)
+	writeMonitors(`
+monitors:
+  - name: backup
+    description: hourly backup
+    interval: 7200
+    tags: [db]
+    depends_on: network
+  - name: network
+    description: gateway
+    interval: 60
+    depends_on: backup
+`)
+	mf, err := loadMonitorsFile(path)
+	ensureNoError(t, err)
+	_, err = reconcile(m, mf)
+	if err == nil {
+		t.Fatalf("dependency cycle was accepted")
+	}
+
+	// Invalid files are rejected without touching the tokens
+	writeMonitors(`
+monitors:
+  - name: backup
+    description: hourly backup
+    interval: 0
+`)
+	err = reconcileFile(m, path, log.Default())
+	if err == nil {
+		t.Fatalf("invalid monitors file was accepted")
+	}
+	writeMonitors(`
+monitors:
+  - name: backup
+    descripton: typo
+    interval: 60
+`)
+	_, err = loadMonitorsFile(path)
+	if err == nil {
+		t.Fatalf("unknown field was accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token modes. A heartbeat token fires when no ping arrived for Interval
+// seconds. An inverse token is the other way around: any ping fires it, and it
+// clears once no ping arrived for Interval seconds. Count tokens fire when
+// fewer (min_count) or more (max_count) than Count pings arrived in the last
+// Interval seconds.
+const (
+	ModeHeartbeat = "heartbeat"
+	ModeInverse   = "inverse"
+	ModeMinCount  = "min_count"
+	ModeMaxCount  = "max_count"
+)
+
+var tokenModes = []string{ModeHeartbeat, ModeInverse, ModeMinCount, ModeMaxCount}
+
+// Rule is how the pings of a token are evaluated by the background job.
+type Rule struct {
+	Mode string
+	// Count is the number of pings per interval of the count modes.
+	Count int
+
+	// Threshold rules on the value sent with the pings, checked on top of the
+	// mode. The token fires when the last value is below MinValue, or more
+	// than MaxDeviation percent away from the average of the values before it.
+	// Zero means no deviation rule.
+	MinValue     *float64
+	MaxDeviation float64
+}
+
+// The deviation rule compares the last value with the average of up to
+// deviationWindow values before it, once there are at least
+// minDeviationSamples of them.
+const (
+	deviationWindow     = 10
+	minDeviationSamples = 3
+)
+
+// withDefaults fills in the parts of the rule left empty.
+func (r Rule) withDefaults() Rule {
+	if r.Mode == "" {
+		r.Mode = ModeHeartbeat
+	}
+	return r
+}
+
+func (r Rule) validate() error {
+	known := false
+	for _, mode := range tokenModes {
+		known = known || r.Mode == mode
+	}
+	switch {
+	case !known:
+		return fmt.Errorf("unknown mode %q", r.Mode)
+	case r.counts() && r.Count <= 0:
+		return fmt.Errorf("mode %s needs a positive count", r.Mode)
+	case !r.counts() && r.Count != 0:
+		return fmt.Errorf("mode %s does not take a count", r.Mode)
+	case r.MinValue != nil && (math.IsNaN(*r.MinValue) || math.IsInf(*r.MinValue, 0)):
+		return errors.New("min value must be a number")
+	case math.IsNaN(r.MaxDeviation) || math.IsInf(r.MaxDeviation, 0) || r.MaxDeviation < 0:
+		return errors.New("max deviation must be a positive percentage")
+	}
+	return nil
+}
+
+// equal tells whether both rules are the same.
+func (r Rule) equal(o Rule) bool {
+	if (r.MinValue == nil) != (o.MinValue == nil) ||
+		r.MinValue != nil && *r.MinValue != *o.MinValue {
+		return false
+	}
+	r.MinValue, o.MinValue = nil, nil
+	return r == o
+}
+
+// counts tells whether the rule is about the number of pings.
+func (r Rule) counts() bool {
+	return r.Mode == ModeMinCount || r.Mode == ModeMaxCount
+}
+
+// String describes the rule for the token list.
+func (r Rule) String() string {
+	var parts []string
+	switch r.Mode {
+	case ModeMinCount:
+		parts = append(parts, fmt.Sprintf("at least %d", r.Count))
+	case ModeMaxCount:
+		parts = append(parts, fmt.Sprintf("at most %d", r.Count))
+	case ModeInverse:
+		parts = append(parts, "inverse")
+	}
+	if r.MinValue != nil {
+		parts = append(parts, "value ≥ "+formatValue(*r.MinValue))
+	}
+	if r.MaxDeviation > 0 {
+		parts = append(parts, "value within "+formatValue(r.MaxDeviation)+"% of average")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// MinValueText is MinValue as shown in the edit form.
+func (r Rule) MinValueText() string {
+	if r.MinValue == nil {
+		return ""
+	}
+	return formatValue(*r.MinValue)
+}
+
+// formatValue prints values without exponents, which are hard to read for
+// things like sizes in bytes.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// evaluate tells whether the pings of t are what its rule expects at now.
+// Tokens that are not healthy are fired.
+func (s *Server) evaluate(t *Token, now time.Time) (bool, error) {
+	healthy, err := s.evaluateMode(t, now)
+	if err != nil || !healthy {
+		return healthy, err
+	}
+	return s.evaluateValues(t)
+}
+
+func (s *Server) evaluateMode(t *Token, now time.Time) (bool, error) {
+	window := time.Duration(t.Interval) * time.Second
+	if t.Rule.counts() {
+		n, err := s.model.CountPings(t.ID, now.Add(-window))
+		if err != nil {
+			return false, fmt.Errorf("counting heartbeats: %w", err)
+		}
+		if t.Rule.Mode == ModeMinCount {
+			return n >= t.Rule.Count, nil
+		}
+		return n <= t.Rule.Count, nil
+	}
+
+	lastPing, err := s.model.LastPing(t.ID)
+	if err != nil {
+		return false, fmt.Errorf("getting last heartbeat: %w", err)
+	}
+	recent := lastPing != nil && now.Unix()-lastPing.Time.Unix() <= int64(t.Interval)
+
+	switch t.Rule.Mode {
+	case ModeInverse:
+		return !recent, nil
+	default:
+		// A failed run counts as a missing heartbeat
+		return recent && lastPing.Status != PingFail, nil
+	}
+}
+
+// evaluateValues checks the threshold rules of t against the last values its
+// pings sent. Tokens with no values yet are healthy.
+func (s *Server) evaluateValues(t *Token) (bool, error) {
+	r := t.Rule
+	if r.MinValue == nil && r.MaxDeviation == 0 {
+		return true, nil
+	}
+	values, err := s.model.LastValues(t.ID, deviationWindow+1)
+	if err != nil {
+		return false, fmt.Errorf("getting values: %w", err)
+	}
+	if len(values) == 0 {
+		return true, nil
+	}
+
+	last := values[0]
+	if r.MinValue != nil && last < *r.MinValue {
+		return false, nil
+	}
+	if r.MaxDeviation > 0 && len(values)-1 >= minDeviationSamples {
+		var sum float64
+		for _, v := range values[1:] {
+			sum += v
+		}
+		avg := sum / float64(len(values)-1)
+		if math.Abs(last-avg) > math.Abs(avg)*r.MaxDeviation/100 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInverseMode(t *testing.T) {
+	server := newTestServer(t)
+	recorder := serve(t, server, "POST", "/newtoken", url.Values{
+		"name":        {"fallback"},
+		"interval":    {"600"},
+		"description": {"fallback path taken"},
+		"mode":        {ModeInverse},
+	})
+	ensureCode(t, recorder, http.StatusFound)
+	list, err := server.model.GetTokens()
+	ensureNoError(t, err)
+	ensureInt(t, len(list), 1)
+	tk := list[0]
+	ensureString(t, tk.Rule.Mode, ModeInverse)
+	ensureNoError(t, server.model.Disable(tk.ID, false))
+
+	check := func(id int, want bool) {
+		t.Helper()
+		server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+		tk, err := server.model.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Fired, want)
+	}
+
+	// No heartbeat is good news
+	check(tk.ID, false)
+	ensureCode(t, serve(t, server, "GET", "/hb/"+tk.Token, nil), http.StatusOK)
+	check(tk.ID, true)
+
+	// It clears once the token has been quiet for the interval, and failed
+	// runs fire it too
+	quiet := mustGetId(t, server.model, mustCreateToken(t, server.model, "quiet", "fallback path taken", 600))
+	ensureNoError(t, server.model.SetRule(quiet, Rule{Mode: ModeInverse}))
+	ensureNoError(t, server.model.Disable(quiet, false))
+	ensureNoError(t, server.model.InsertHeartBeat(quiet, Ping{Time: time.Now().Add(-time.Hour)}))
+	check(quiet, false)
+	ensureNoError(t, server.model.InsertHeartBeat(quiet, Ping{Status: PingFail}))
+	check(quiet, true)
+
+	ensureCode(t, serve(t, server, "POST", "/newtoken", url.Values{
+		"name":        {"typo"},
+		"interval":    {"600"},
+		"description": {"unknown mode"},
+		"mode":        {"sometimes"},
+	}), http.StatusFound)
+	list, err = server.model.GetTokens()
+	ensureNoError(t, err)
+	ensureInt(t, len(list), 2)
+}
+
+func TestCountModes(t *testing.T) {
+	server := newTestServer(t)
+	recorder := serve(t, server, "POST", "/newtoken", url.Values{
+		"name":        {"queue worker"},
+		"interval":    {"3600"},
+		"description": {"pings per processed batch"},
+		"mode":        {ModeMinCount},
+		"count":       {"3"},
+	})
+	ensureCode(t, recorder, http.StatusFound)
+	var workers int
+	list, err := server.model.GetTokens()
+	ensureNoError(t, err)
+	for _, tk := range list {
+		if tk.Name == "queue worker" {
+			workers = tk.ID
+			ensureString(t, tk.Rule.Mode, ModeMinCount)
+			ensureInt(t, tk.Rule.Count, 3)
+		}
+	}
+	retries := mustGetId(t, server.model, mustCreateToken(t, server.model, "retries", "desc", 3600))
+	ensureNoError(t, server.model.SetRule(retries, Rule{Mode: ModeMaxCount, Count: 2}))
+	for _, id := range []int{workers, retries} {
+		ensureNoError(t, server.model.Disable(id, false))
+	}
+
+	check := func(id int, want bool) {
+		t.Helper()
+		server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+		tk, err := server.model.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Fired, want)
+	}
+	ping := func(id int, ago time.Duration) {
+		t.Helper()
+		ensureNoError(t, server.model.InsertHeartBeat(id, Ping{Time: time.Now().Add(-ago)}))
+	}
+
+	// Pings out of the window do not count
+	ping(workers, 2*time.Hour)
+	ping(workers, time.Minute)
+	ping(workers, time.Minute)
+	check(workers, true)
+	ping(workers, time.Second)
+	check(workers, false)
+
+	check(retries, false)
+	ping(retries, time.Minute)
+	ping(retries, time.Minute)
+	check(retries, false)
+	ping(retries, time.Second)
+	check(retries, true)
+
+	for _, f := range []url.Values{
+		{"mode": {ModeMaxCount}},
+		{"mode": {ModeMinCount}, "count": {"many"}},
+		{"mode": {ModeHeartbeat}, "count": {"3"}},
+	} {
+		f.Set("name", "bad")
+		f.Set("interval", "60")
+		f.Set("description", "desc")
+		ensureCode(t, serve(t, server, "POST", "/newtoken", f), http.StatusFound)
+	}
+	list, err = server.model.GetTokens()
+	ensureNoError(t, err)
+	ensureInt(t, len(list), 2)
+}
+
+func TestCountModesLimits(t *testing.T) {
+	// Pings of count tokens are neither coalesced nor limited per token
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		tokenRate:      2,
+		minPingSpacing: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	workersToken := mustCreateToken(t, server.model, "queue worker", "desc", 3600)
+	workers := mustGetId(t, server.model, workersToken)
+	ensureNoError(t, server.model.SetRule(workers, Rule{Mode: ModeMinCount, Count: 5}))
+	retriesToken := mustCreateToken(t, server.model, "retries", "desc", 3600)
+	retries := mustGetId(t, server.model, retriesToken)
+	ensureNoError(t, server.model.SetRule(retries, Rule{Mode: ModeMaxCount, Count: 3}))
+	for _, id := range []int{workers, retries} {
+		ensureNoError(t, server.model.Disable(id, false))
+	}
+
+	for i := 0; i < 5; i++ {
+		ensureString(t, serve(t, server, "GET", "/hb/"+workersToken, nil).Body.String(), "ok t="+workersToken)
+	}
+	for i := 0; i < 4; i++ {
+		ensureString(t, serve(t, server, "GET", "/hb/"+retriesToken, nil).Body.String(), "ok t="+retriesToken)
+	}
+
+	server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+	for id, want := range map[int]bool{workers: false, retries: true} {
+		tk, err := server.model.GetToken(id)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Fired, want)
+	}
+}
+
+func TestThresholdRules(t *testing.T) {
+	server := newTestServer(t)
+	recorder := serve(t, server, "POST", "/newtoken", url.Values{
+		"name":          {"backup"},
+		"interval":      {"3600"},
+		"description":   {"db backup"},
+		"min_value":     {"1000"},
+		"max_deviation": {"50"},
+	})
+	ensureCode(t, recorder, http.StatusFound)
+	list, err := server.model.GetTokens()
+	ensureNoError(t, err)
+	ensureInt(t, len(list), 1)
+	tk := list[0]
+	if tk.Rule.MinValue == nil || *tk.Rule.MinValue != 1000 || tk.Rule.MaxDeviation != 50 {
+		t.Fatalf("thresholds not saved: %+v", tk.Rule)
+	}
+	ensureNoError(t, server.model.Disable(tk.ID, false))
+
+	hb := func(value string, fired bool) {
+		t.Helper()
+		ensureCode(t, serve(t, server, "GET", "/hb/"+tk.Token+"?value="+value+"&unit=bytes", nil), http.StatusOK)
+		server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+		tk, err := server.model.GetToken(tk.ID)
+		ensureNoError(t, err)
+		ensureBool(t, tk.Fired, fired)
+	}
+
+	// Too few values for the deviation rule
+	hb("50000", false)
+	hb("5000", false)
+	hb("20000", false)
+	// Average 25000
+	hb("30000", false)
+	hb("2000", true)
+	hb("25000", false)
+	hb("12", true)
+
+	recorder = serve(t, server, "GET", "/history/"+strconv.Itoa(tk.ID), nil)
+	cells := parseGeneric(t, recorder.Body.String(), "td", "ping-value")
+	ensureInt(t, len(cells), 7)
+	ensureString(t, cells[0].Text, "12 bytes")
+
+	ensureCode(t, serve(t, server, "GET", "/hb/"+tk.Token+"?value=lots", nil), http.StatusBadRequest)
+	ensureCode(t, serve(t, server, "GET", "/hb/"+tk.Token+"?value=NaN", nil), http.StatusBadRequest)
+
+	recorder = serve(t, server, "GET", "/", nil)
+	if !strings.Contains(recorder.Body.String(), "value ≥ 1000, value within 50% of average") {
+		t.Fatalf("token list does not show the thresholds:\n%s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/drio/kea/client"
+)
+
+// runOpts configures a job wrapped by kae run.
+type runOpts struct {
+	client *client.Client
+	token  string
+	args   []string
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: kae run -token token [-url url] -- command [args...]
+
+Run command and report it to kae: a start ping before it runs, then an ok or
+fail ping with its exit code, duration and the tail of its output. kae run
+exits with the exit code of the command.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	serverURL := fs.String("url", "", "kae server URL (default $KAE_URL or "+defaultServerURL+")")
+	token := fs.String("token", os.Getenv("KAE_TOKEN"), "token to ping (default $KAE_TOKEN)")
+	spoolDir := fs.String("spool", os.Getenv("KAE_SPOOL_DIR"),
+		"directory to keep pings kae could not receive, sent again on the next run (default $KAE_SPOOL_DIR)")
+	exitOnError(fs.Parse(args))
+
+	if *token == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("run: a token and a command are required")
+	}
+
+	runID := make([]byte, 8)
+	_, err := rand.Read(runID)
+	if err != nil {
+		return err
+	}
+	c := client.New(newAPIClientFromEnv(*serverURL).baseURL)
+	c.SpoolDir = *spoolDir
+	c.RunID = hex.EncodeToString(runID)
+	code, err := runJob(runOpts{
+		client: c,
+		token:  *token,
+		args:   fs.Args(),
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	})
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// runJob runs the command in opts between a start and a final ping and
+// returns its exit code. Failing to reach kae is reported on stderr but does
+// not stop the job. The error is only set when the command cannot be started.
+func runJob(opts runOpts) (int, error) {
+	ctx := context.Background()
+	report := func(err error) {
+		if err != nil {
+			fmt.Fprintf(opts.stderr, "kae run: %s\n", err)
+		}
+	}
+
+	report(opts.client.Start(ctx, opts.token))
+
+	tail := &tailBuffer{max: maxPingOutput}
+	cmd := exec.Command(opts.args[0], opts.args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(opts.stdout, tail)
+	cmd.Stderr = io.MultiWriter(opts.stderr, tail)
+
+	start := time.Now()
+	err := cmd.Run()
+	result := client.Result{Duration: time.Since(start)}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+		if result.ExitCode < 0 {
+			// Killed by a signal
+			result.ExitCode = 1
+		}
+	case err != nil:
+		fmt.Fprintf(tail, "kae run: %s\n", err)
+		report(opts.client.Finish(ctx, opts.token, client.Result{ExitCode: -1, Output: tail.String()}))
+		return 0, err
+	}
+
+	result.Output = tail.String()
+	report(opts.client.Finish(ctx, opts.token, result))
+	return result.ExitCode, nil
+}
+
+// tailBuffer is a writer that keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/drio/kea/client"
+)
+
+func TestRunJob(t *testing.T) {
+	server := newTestServer(t)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	token := mustCreateToken(t, server.model, "backup", "db backup", 3600)
+	id := mustGetId(t, server.model, token)
+	ensureNoError(t, server.model.Disable(id, false))
+
+	run := func(script string) (int, string) {
+		t.Helper()
+		var out, stderr bytes.Buffer
+		code, err := runJob(runOpts{
+			client: runClient(ts),
+			token:  token,
+			args:   []string{"sh", "-c", script},
+			stdout: &out,
+			stderr: &stderr,
+		})
+		ensureNoError(t, err)
+		return code, out.String()
+	}
+	checkRun := func() {
+		t.Helper()
+		server.runBackgroundJob(bgJobOpts{delayFn: func() {}})
+	}
+
+	code, out := run("echo copied")
+	ensureInt(t, code, 0)
+	ensureString(t, out, "copied\n")
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingOK)
+	ensureString(t, last.Output, "copied\n")
+	checkRun()
+	tk, err := server.model.GetToken(id)
+	ensureNoError(t, err)
+	ensureBool(t, tk.Fired, false)
+
+	// A failing command fires the token even though it pinged in time
+	code, _ = run("echo uploading; echo s3 unreachable >&2; exit 3")
+	ensureInt(t, code, 3)
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingFail)
+	if last.ExitCode == nil || *last.ExitCode != 3 {
+		t.Fatalf("got exit code %v, want 3", last.ExitCode)
+	}
+	if !strings.Contains(last.Output, "s3 unreachable") {
+		t.Fatalf("output %q is missing stderr", last.Output)
+	}
+	checkRun()
+	tk, err = server.model.GetToken(id)
+	ensureNoError(t, err)
+	ensureBool(t, tk.Fired, true)
+
+	// Commands that cannot be started are reported too
+	_, err = runJob(runOpts{
+		client: runClient(ts),
+		token:  token,
+		args:   []string{"/does/not/exist"},
+		stdout: &bytes.Buffer{},
+		stderr: &bytes.Buffer{},
+	})
+	if err == nil {
+		t.Fatalf("expected an error running a missing command")
+	}
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingFail)
+}
+
+func runClient(ts *httptest.Server) *client.Client {
+	c := client.New(ts.URL)
+	c.HTTPClient = ts.Client()
+	c.Retries = 0
+	return c
+}
+
+func TestHeartBeatStatus(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "backup", "db backup", 3600)
+	id := mustGetId(t, server.model, token)
+
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?status=bogus", nil), http.StatusBadRequest)
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?duration=-1", nil), http.StatusBadRequest)
+
+	// A non zero exit code without status is a failure
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?exit_code=1&duration=2.5", nil), http.StatusOK)
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingFail)
+	ensureString(t, last.Duration.String(), "2.5s")
+
+	r := httptest.NewRequest("POST", "/hb/"+token, strings.NewReader(strings.Repeat("x", maxPingOutput)+"end"))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusOK)
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingOK)
+	ensureInt(t, len(last.Output), maxPingOutput)
+	if !strings.HasSuffix(last.Output, "end") {
+		t.Fatalf("output does not keep the tail")
+	}
+
+	// The output is not cut in the middle of a character
+	r = httptest.NewRequest("POST", "/hb/"+token, strings.NewReader(strings.Repeat("€", maxPingOutput)))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusOK)
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureInt(t, len(last.Output), maxPingOutput-maxPingOutput%3)
+	ensureBool(t, utf8.ValidString(last.Output), true)
+}
+
+func TestBackdatedHeartBeat(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "backup", "db backup", 3600)
+	id := mustGetId(t, server.model, token)
+	ts := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?ts="+ts(-10*time.Minute), nil), http.StatusOK)
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	if d := time.Since(last.Time); d < 9*time.Minute || d > 11*time.Minute {
+		t.Fatalf("got ping %s ago, want 10m", d)
+	}
+
+	// Outside the window
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?ts="+ts(-2*time.Hour), nil), http.StatusBadRequest)
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?ts="+ts(time.Hour), nil), http.StatusBadRequest)
+
+	// A late replay does not hide a newer ping
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token, nil), http.StatusOK)
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token+"?status=fail&ts="+ts(-5*time.Minute), nil), http.StatusOK)
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingOK)
+}
@@ -2,10 +2,12 @@
 
 set -e
 
-sqlite3 /data/kae/kae.sqlite "VACUUM INTO '/tmp/db.kae'"
-gzip /tmp/db.kae
-
-aws s3 cp /tmp/db.kae.gz s3://drio-kae-backup/backup-`date +%d%H`.gz
-
-curl https://kae.driohq.net/hb/vzndxvgbtlzqlkjrfkkz &> /dev/null
-rm -f /tmp/db.kae /tmp/db.kae.gz
+KAE=$(dirname "$0")/../main-linux-amd64
+
+# kae run pings before and after the backup and reports a failure, with the
+# tail of the output, if any step fails.
+KAE_URL=https://kae.driohq.net $KAE run -token vzndxvgbtlzqlkjrfkkz -- bash -ec '
+  trap "rm -f /tmp/db.kae.gz" EXIT
+  KAE_DB=/data/kae/kae.sqlite '"$KAE"' backup -gzip -o /tmp/db.kae.gz
+  aws s3 cp /tmp/db.kae.gz s3://drio-kae-backup/backup-`date +%d%H`.gz
+'
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -18,14 +22,45 @@ type ServerOpts struct {
 	model          Model
 	logger         Logger
 	authMiddleware func(next http.Handler) http.Handler
+	// whether authMiddleware asks for credentials; the database backup is
+	// only served when it does
+	authenticated bool
+	// how long a token string keeps working after it has been rotated
+	rotateOverlap time.Duration
+	// how far in the past a heartbeat can be backdated with ts
+	maxPingAge time.Duration
+	// status code of heartbeats for unknown or deleted tokens, 200 if unset
+	orphanStatus int
+	// proxies whose X-Forwarded-For header we believe
+	trustedProxies []*net.IPNet
+	// heartbeats allowed per minute for a token string and for a client
+	// address, 0 for no limit
+	tokenRate int
+	ipRate    int
+	// pings repeating the status of the previous one within this time are
+	// not recorded
+	minPingSpacing time.Duration
 }
 
 type Server struct {
-	model  Model
-	logger Logger
+	model         Model
+	logger        Logger
+	rotateOverlap time.Duration
+	maxPingAge    time.Duration
+	orphanStatus  int
+	proxies       []*net.IPNet
+	authenticated bool
+
+	tokenLimiter *rateLimiter
+	ipLimiter    *rateLimiter
+	coalescer    *coalescer
+	hbStats      hbStats
 
 	mux            *chi.Mux
 	homeTmpl       *template.Template
+	editTmpl       *template.Template
+	orphansTmpl    *template.Template
+	historyTmpl    *template.Template
 	authMiddleware func(next http.Handler) http.Handler
 }
 
@@ -37,19 +72,43 @@ type Model interface {
 	CreateToken(string, string, int) (string, error)
 	GetTokens() (ListTokens, error)
 	GetIdFromToken(string) (int, error)
-	InsertHeartBeat(int) error
-	LastHeartBeat(int) (time.Time, error)
+	InsertHeartBeat(int, Ping) error
+	InsertHeartBeats([]HeartBeat) error
+	LastPing(int) (*Ping, error)
+	GetPings(int, int) ([]Ping, error)
+	CountPings(int, time.Time) (int, error)
+	LastValues(int, int) ([]float64, error)
 	Fire(int, bool) error
 	Disable(int, bool) error
+	Block(int, bool) error
 	Remove(int) error
+	SetTags(int, []string) error
+	SetRule(int, Rule) error
+	GetToken(int) (*Token, error)
+	UpdateToken(int, TokenUpdate) error
+	RotateToken(int, time.Duration) (string, error)
+	ImportToken(*Token) (int, error)
+	InsertOrphanPing(OrphanPing) error
+	GetOrphanPings(int) ([]OrphanPing, error)
 }
 
 func NewServer(opts ServerOpts) (*Server, error) {
+	if opts.orphanStatus == 0 {
+		opts.orphanStatus = http.StatusOK
+	}
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	s := &Server{
 		model:          opts.model,
 		logger:         opts.logger,
+		rotateOverlap:  opts.rotateOverlap,
+		maxPingAge:     opts.maxPingAge,
+		orphanStatus:   opts.orphanStatus,
+		proxies:        opts.trustedProxies,
+		authenticated:  opts.authenticated,
+		tokenLimiter:   newRateLimiter(opts.tokenRate),
+		ipLimiter:      newRateLimiter(opts.ipRate),
+		coalescer:      newCoalescer(opts.minPingSpacing),
 		mux:            r,
 		authMiddleware: opts.authMiddleware,
 	}
@@ -59,12 +118,15 @@ func NewServer(opts ServerOpts) (*Server, error) {
 	FileServer(r, "/assets", filesDir)
 
 	s.addRoutes()
+	s.addAPIRoutes()
 	s.addTemplates()
 	return s, nil
 }
 
 func (s *Server) addRoutes() {
+	s.mux.Post("/hb/batch", s.hbBatch)
 	s.mux.Get("/hb/{token}", s.hbToken)
+	s.mux.Post("/hb/{token}", s.hbToken)
 
 	// These have to be protected
 	m := s.authMiddleware
@@ -72,6 +134,15 @@ func (s *Server) addRoutes() {
 	s.mux.Method("post", "/newtoken", m(http.HandlerFunc(s.createToken)))
 	s.mux.Method("get", "/{action:enable|disable}/{id}", m(http.HandlerFunc(s.updateDisable)))
 	s.mux.Method("get", "/delete/{id}", m(http.HandlerFunc(s.remove)))
+	s.mux.Method("get", "/edit/{id}", m(http.HandlerFunc(s.editForm)))
+	s.mux.Method("post", "/edit/{id}", m(http.HandlerFunc(s.updateToken)))
+	s.mux.Method("post", "/rotate/{id}", m(http.HandlerFunc(s.rotateToken)))
+	s.mux.Method("get", "/history/{id}", m(http.HandlerFunc(s.history)))
+	s.mux.Method("get", "/orphans", m(http.HandlerFunc(s.orphans)))
+	s.mux.Method("get", "/admin/backup", m(http.HandlerFunc(s.backup)))
+	s.mux.Method("get", "/admin/hb-stats", m(http.HandlerFunc(s.hbStatsHandler)))
+	s.mux.Method("get", "/api/export", m(http.HandlerFunc(s.exportTokens)))
+	s.mux.Method("post", "/api/import", m(http.HandlerFunc(s.importTokens)))
 }
 
 func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
@@ -125,76 +196,303 @@ func (s *Server) updateDisable(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
-	name := strings.TrimSpace(r.FormValue("name"))
-	if name == "" {
+	f, err := parseTokenForm(r)
+	if err != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	desc := r.FormValue("description")
-	if desc == "" {
-		http.Redirect(w, r, "/", http.StatusFound)
+	token, err := s.model.CreateToken(f.Name, f.Description, f.Interval)
+	if err != nil {
+		s.internalError(w, "creating new token", err)
 		return
 	}
 
-	interval := strings.TrimSpace(r.FormValue("interval"))
-	if interval == "" {
-		http.Redirect(w, r, "/", http.StatusFound)
+	id, err := s.model.GetIdFromToken(token)
+	if err != nil {
+		s.internalError(w, "looking up new token", err)
+		return
+	}
+	err = s.model.UpdateToken(id, f.update())
+	if err != nil {
+		s.internalError(w, "setting token fields", err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (s *Server) editForm(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	s.renderEdit(w, http.StatusOK, t.ID, tokenForm{
+		Name:        t.Name,
+		Description: t.Description,
+		Interval:    t.Interval,
+		Tags:        t.Tags,
+		Rule:        t.Rule,
+		DependsOn:   t.DependsOn,
+	}, "")
+}
+
+func (s *Server) updateToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
 		return
 	}
 
-	intInterval, err := strconv.Atoi(interval)
+	f, err := parseTokenForm(r)
 	if err != nil {
-		http.Redirect(w, r, "/", http.StatusFound)
+		s.renderEdit(w, http.StatusBadRequest, t.ID, f, err.Error())
 		return
 	}
 
-	_, err = s.model.CreateToken(name, desc, intInterval)
+	err = s.model.UpdateToken(t.ID, f.update())
+	if err == errDependencyCycle || err == errNoSuchDependency {
+		s.renderEdit(w, http.StatusBadRequest, t.ID, f, err.Error())
+		return
+	}
 	if err != nil {
-		s.internalError(w, "creating new token", err)
+		s.internalError(w, "updating token", err)
 		return
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func (s *Server) hbToken(w http.ResponseWriter, r *http.Request) {
-	token := chi.URLParam(r, "token")
-	if token == "" {
-		s.badRequestError(w, "token not provided", nil)
+func (s *Server) rotateToken(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
 		return
 	}
 
-	id, err := s.model.GetIdFromToken(token)
+	_, err := s.model.RotateToken(t.ID, s.rotateOverlap)
 	if err != nil {
-		s.internalError(w, "checking for token", err)
+		s.internalError(w, "rotating token", err)
 		return
 	}
+	s.logger.Printf("rotated token id:%d, old token valid for %s", t.ID, s.rotateOverlap)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// tokenFromURL loads the token referenced by the id URL parameter. It writes
+// the error response and returns false if the token cannot be loaded.
+func (s *Server) tokenFromURL(w http.ResponseWriter, r *http.Request) (*Token, bool) {
+	id := chi.URLParam(r, "id")
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		s.badRequestError(w, "invalid token id", err)
+		return nil, false
+	}
 
-	if id == 0 {
-		_, err = w.Write([]byte(fmt.Sprintf("ok t=%s (nd)", token)))
-		if err != nil {
-			s.internalError(w, "writing back to the user", err)
+	t, err := s.model.GetToken(intID)
+	if err != nil {
+		s.internalError(w, "loading token", err)
+		return nil, false
+	}
+	if t == nil {
+		http.Error(w, "error token not found", http.StatusNotFound)
+		return nil, false
+	}
+	return t, true
+}
+
+func (s *Server) renderEdit(w http.ResponseWriter, code int, id int, f tokenForm, errMsg string) {
+	list, err := s.model.GetTokens()
+	if err != nil {
+		s.internalError(w, "getting tokens", err)
+		return
+	}
+	// The tokens this one can depend on
+	var others ListTokens
+	for _, t := range list {
+		if t.ID != id {
+			others = append(others, t)
 		}
+	}
+
+	var data = struct {
+		ID            int
+		Form          tokenForm
+		Tags          string
+		Error         string
+		RotateOverlap time.Duration
+		Others        ListTokens
+	}{
+		ID:            id,
+		Form:          f,
+		Tags:          strings.Join(f.Tags, ", "),
+		Error:         errMsg,
+		RotateOverlap: s.rotateOverlap,
+		Others:        others,
+	}
+
+	w.WriteHeader(code)
+	err = s.editTmpl.Execute(w, data)
+	if err != nil {
+		s.logger.Printf("error rendering edit template: %v", err)
+	}
+}
+
+// Number of pings shown in /history/{id}.
+const historyPageSize = 100
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.tokenFromURL(w, r)
+	if !ok {
+		return
+	}
+	pings, err := s.model.GetPings(t.ID, historyPageSize)
+	if err != nil {
+		s.internalError(w, "getting pings", err)
 		return
 	}
 
-	err = s.model.InsertHeartBeat(id)
+	var data = struct {
+		Token *Token
+		Pings []Ping
+		Limit int
+	}{
+		Token: t,
+		Pings: pings,
+		Limit: historyPageSize,
+	}
+	err = s.historyTmpl.Execute(w, data)
+	if err != nil {
+		s.logger.Printf("error rendering history template: %v", err)
+	}
+}
+
+// Number of orphan pings shown in /orphans.
+const orphansPageSize = 200
+
+func (s *Server) orphans(w http.ResponseWriter, r *http.Request) {
+	pings, err := s.model.GetOrphanPings(orphansPageSize)
 	if err != nil {
-		s.internalError(w, "heartbeat", err)
+		s.internalError(w, "getting orphan pings", err)
+		return
+	}
+	var data = struct {
+		Pings []OrphanPing
+	}{
+		Pings: pings,
+	}
+	err = s.orphansTmpl.Execute(w, data)
+	if err != nil {
+		s.logger.Printf("error rendering orphans template: %v", err)
+	}
+}
+
+func (s *Server) backup(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticated {
+		http.Error(w, "error backups need basic auth to be configured", http.StatusForbidden)
 		return
 	}
+	b, ok := backuperFor(s.model)
+	if !ok {
+		http.Error(w, "error backups are not supported by this storage", http.StatusNotImplemented)
+		return
+	}
+
+	compress := r.URL.Query().Get("gzip") != ""
+	name := "kae-" + time.Now().UTC().Format("20060102-150405") + ".sqlite"
+	if compress {
+		name += ".gz"
+	}
 
-	// respond to the client
-	_, err = w.Write([]byte(fmt.Sprintf("ok t=%s", token)))
+	// The snapshot is streamed, so once the first byte is out we can only log
+	// errors.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	err := writeBackup(b, w, compress)
 	if err != nil {
-		s.internalError(w, "writing back to the user", err)
+		s.logger.Printf("error writing backup: %v", err)
+	}
+}
+
+func (s *Server) exportTokens(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
 	}
 
+	export, err := exportTokens(s.model)
+	if err != nil {
+		s.internalError(w, "exporting tokens", err)
+		return
+	}
+	data, err := marshalExport(export, format)
+	if err != nil {
+		s.badRequestError(w, err.Error(), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/"+format)
+	_, err = w.Write(data)
+	if err != nil {
+		s.logger.Printf("error writing export: %v", err)
+	}
+}
+
+func (s *Server) importTokens(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = formatJSON
+		if strings.Contains(r.Header.Get("Content-Type"), "yaml") {
+			format = formatYAML
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize))
+	if err != nil {
+		s.badRequestError(w, "reading body", err)
+		return
+	}
+	export, err := unmarshalExport(data, format)
+	if err != nil {
+		s.badRequestError(w, "parsing tokens: "+err.Error(), err)
+		return
+	}
+
+	err = export.validate()
+	if err != nil {
+		s.badRequestError(w, err.Error(), err)
+		return
+	}
+
+	result, err := importTokens(s.model, export)
+	if errors.Is(err, errTokenInUse) {
+		http.Error(w, "error "+err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.internalError(w, "importing tokens", err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+// maxImportSize bounds the body of /api/import.
+const maxImportSize = 10 << 20
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		s.logger.Printf("error writing json: %v", err)
+	}
 }
 
 func (s *Server) addTemplates() {
 	s.homeTmpl = template.Must(template.New("home").Parse(homeTmpl))
+	s.editTmpl = template.Must(template.New("edit").Parse(editTmpl))
+	s.orphansTmpl = template.Must(template.New("orphans").Parse(orphansTmpl))
+	s.historyTmpl = template.Must(template.New("history").Parse(historyTmpl))
 }
 
 func (s *Server) home(w http.ResponseWriter, r *http.Request) {
@@ -204,14 +502,27 @@ func (s *Server) home(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Names of the tokens, for the ones depending on them
+	names := map[int]string{}
+	for _, t := range list {
+		names[t.ID] = t.Name
+	}
+
+	filter := filterFromQuery(r.URL.Query())
 	var data = struct {
 		Name   string
 		SayHi  bool
-		Tokens ListTokens
+		Filter TokenFilter
+		States []string
+		Groups []TokenGroup
+		Names  map[int]string
 	}{
 		Name:   "david",
 		SayHi:  false,
-		Tokens: list,
+		Filter: filter,
+		States: tokenStates,
+		Groups: filter.GroupBy(filter.Apply(list)),
+		Names:  names,
 	}
 
 	err = s.homeTmpl.Execute(w, data)
@@ -4,34 +4,23 @@ package main
 // https://benhoyt.com/writings/simple-lists/
 
 import (
-	"database/sql"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/html"
 )
 
 func TestServer(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("opening database: %v", err)
-	}
-	defer db.Close()
-	model, err := NewSQLModel(db)
-	exitOnError(err)
-	server, err := NewServer(ServerOpts{
-		model:          model,
-		logger:         log.Default(),
-		authMiddleware: noAuthMiddleware,
-	})
-	if err != nil {
-		t.Fatalf("Error creating server")
-	}
+	server := newTestServer(t)
 
 	// Fetch homepage
 	{
@@ -39,8 +28,10 @@ func TestServer(t *testing.T) {
 
 		ensureCode(t, recorder, http.StatusOK)
 		forms := parseForms(t, recorder.Body.String())
-		ensureInt(t, len(forms), 1)
+		ensureInt(t, len(forms), 2)
 		ensureString(t, forms[0].Action, "/newtoken")
+		ensureString(t, forms[1].Action, "/")
+		ensureString(t, forms[1].Method, "GET")
 	}
 
 	// Create a token
@@ -73,15 +64,19 @@ func TestServer(t *testing.T) {
 		recorder := serve(t, server, "GET", "/", nil)
 
 		links := parseLinks(t, recorder.Body.String())
-		ensureInt(t, len(links), 4) // 2 tokens, each has a delete and enable
+		ensureInt(t, len(links), 7) // 2 tokens, each has a delete, edit and enable, and the orphans page
 		ensureString(t, links[0].Href, "/delete/2")
 		ensureString(t, links[0].Text, "delete")
-		ensureString(t, links[1].Href, "/enable/2")
-		ensureString(t, links[1].Text, "enable")
-		ensureString(t, links[2].Href, "/delete/1")
-		ensureString(t, links[2].Text, "delete")
-		ensureString(t, links[3].Href, "/enable/1")
-		ensureString(t, links[3].Text, "enable")
+		ensureString(t, links[1].Href, "/edit/2")
+		ensureString(t, links[1].Text, "edit")
+		ensureString(t, links[2].Href, "/enable/2")
+		ensureString(t, links[2].Text, "enable")
+		ensureString(t, links[3].Href, "/delete/1")
+		ensureString(t, links[3].Text, "delete")
+		ensureString(t, links[4].Href, "/edit/1")
+		ensureString(t, links[4].Text, "edit")
+		ensureString(t, links[5].Href, "/enable/1")
+		ensureString(t, links[5].Text, "enable")
 	}
 
 	// Enable a token
@@ -96,11 +91,11 @@ func TestServer(t *testing.T) {
 	{
 		recorder := serve(t, server, "GET", "/", nil)
 		links := parseLinks(t, recorder.Body.String())
-		ensureInt(t, len(links), 4)
+		ensureInt(t, len(links), 7)
 		ensureString(t, links[0].Href, "/delete/2")
 		ensureString(t, links[0].Text, "delete")
-		ensureString(t, links[1].Href, "/disable/2")
-		ensureString(t, links[1].Text, "disable")
+		ensureString(t, links[2].Href, "/disable/2")
+		ensureString(t, links[2].Text, "disable")
 	}
 
 	// Delete a token
@@ -115,11 +110,11 @@ func TestServer(t *testing.T) {
 	{
 		recorder := serve(t, server, "GET", "/", nil)
 		links := parseLinks(t, recorder.Body.String())
-		ensureInt(t, len(links), 2)
+		ensureInt(t, len(links), 4)
 		ensureString(t, links[0].Href, "/delete/1")
 		ensureString(t, links[0].Text, "delete")
-		ensureString(t, links[1].Href, "/enable/1")
-		ensureString(t, links[1].Text, "enable")
+		ensureString(t, links[2].Href, "/enable/1")
+		ensureString(t, links[2].Text, "enable")
 	}
 
 	// Get the token value and send a heartbeat
@@ -164,6 +159,526 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestTagsAndFilters(t *testing.T) {
+	server := newTestServer(t)
+
+	// Create three tokens, two of them tagged
+	for _, tk := range []struct{ name, desc, tags string }{
+		{"backup db", "hourly sqlite backup", "db, Backup"},
+		{"backup photos", "nightly rsync", "backup"},
+		{"cert renewal", "letsencrypt", ""},
+	} {
+		form := url.Values{}
+		form.Set("name", tk.name)
+		form.Set("interval", "60")
+		form.Set("description", tk.desc)
+		form.Set("tags", tk.tags)
+		recorder := serve(t, server, "POST", "/newtoken", form)
+		ensureCode(t, recorder, http.StatusFound)
+	}
+
+	names := func(path string) []string {
+		recorder := serve(t, server, "GET", path, nil)
+		ensureCode(t, recorder, http.StatusOK)
+		var out []string
+		for _, d := range parseGeneric(t, recorder.Body.String(), "span", "token-name") {
+			out = append(out, d.Text)
+		}
+		return out
+	}
+
+	ensureInt(t, len(names("/")), 3)
+	ensureInt(t, len(names("/?tag=backup")), 2)
+	ensureInt(t, len(names("/?tag=db")), 1)
+	ensureInt(t, len(names("/?tag=Backup")), 2)
+	ensureInt(t, len(names("/?q=LETSENCRYPT")), 1)
+	ensureInt(t, len(names("/?q=backup&tag=db")), 1)
+	ensureInt(t, len(names("/?state=disabled")), 3)
+	ensureInt(t, len(names("/?state=fired")), 0)
+
+	// Grouping by tag repeats tokens that have several tags
+	{
+		recorder := serve(t, server, "GET", "/?group=tag", nil)
+		groups := parseGeneric(t, recorder.Body.String(), "h3", "group-name")
+		ensureInt(t, len(groups), 3)
+		ensureString(t, groups[0].Text, "backup")
+		ensureString(t, groups[1].Text, "db")
+		ensureString(t, groups[2].Text, "untagged")
+		ensureInt(t, len(names("/?group=tag")), 4)
+	}
+
+	// Tags are escaped
+	form := url.Values{}
+	form.Set("name", "xss")
+	form.Set("interval", "60")
+	form.Set("description", "desc")
+	form.Set("tags", "<script>alert(1)</script>")
+	ensureCode(t, serve(t, server, "POST", "/newtoken", form), http.StatusFound)
+	body := serve(t, server, "GET", "/?tag=<script>alert(1)</script>", nil).Body.String()
+	if strings.Contains(body, "<script>") {
+		t.Fatalf("tag is not escaped:\n%s", body)
+	}
+	tags := parseGeneric(t, body, "a", "tag")
+	ensureInt(t, len(tags), 1)
+	ensureString(t, tags[0].Text, "#<script>alert(1)</script>")
+}
+
+func TestEditToken(t *testing.T) {
+	server := newTestServer(t)
+
+	form := url.Values{}
+	form.Set("name", "nightly")
+	form.Set("interval", "60")
+	form.Set("description", "nightly job")
+	ensureCode(t, serve(t, server, "POST", "/newtoken", form), http.StatusFound)
+
+	tokenValue := func() string {
+		recorder := serve(t, server, "GET", "/", nil)
+		divs := parseGeneric(t, recorder.Body.String(), "div", "token-value")
+		ensureInt(t, len(divs), 1)
+		return divs[0].Text
+	}
+	before := tokenValue()
+	ensureCode(t, serve(t, server, "GET", "/hb/"+before, nil), http.StatusOK)
+
+	// The edit form comes pre-filled
+	{
+		recorder := serve(t, server, "GET", "/edit/1", nil)
+		ensureCode(t, recorder, http.StatusOK)
+		forms := parseForms(t, recorder.Body.String())
+		ensureInt(t, len(forms), 2)
+		ensureString(t, forms[0].Action, "/edit/1")
+		ensureString(t, forms[1].Action, "/rotate/1")
+		ensureString(t, forms[0].Inputs["name"], "nightly")
+		ensureString(t, forms[0].Inputs["interval"], "60")
+	}
+
+	// Invalid values are rejected
+	{
+		form := url.Values{}
+		form.Set("name", "nightly")
+		form.Set("interval", "-5")
+		form.Set("description", "nightly job")
+		recorder := serve(t, server, "POST", "/edit/1", form)
+		ensureCode(t, recorder, http.StatusBadRequest)
+	}
+
+	// Valid values are saved and the token string is preserved
+	{
+		form := url.Values{}
+		form.Set("name", "nightly backup")
+		form.Set("interval", "3600")
+		form.Set("description", "nightly job")
+		form.Set("tags", "backup")
+		recorder := serve(t, server, "POST", "/edit/1", form)
+		ensureCode(t, recorder, http.StatusFound)
+
+		tk, err := server.model.GetToken(1)
+		if err != nil {
+			t.Fatalf("getting token: %v", err)
+		}
+		ensureString(t, tk.Name, "nightly backup")
+		ensureInt(t, tk.Interval, 3600)
+		ensureInt(t, len(tk.Tags), 1)
+		ensureString(t, tk.Token, before)
+		ensureString(t, tokenValue(), before)
+
+		lastHB, err := server.model.LastPing(1)
+		if err != nil {
+			t.Fatalf("getting last heartbeat: %v", err)
+		}
+		if lastHB == nil {
+			t.Fatalf("ping history lost after edit")
+		}
+	}
+
+	ensureCode(t, serve(t, server, "GET", "/edit/42", nil), http.StatusNotFound)
+}
+
+func TestRotateToken(t *testing.T) {
+	server := newTestServer(t)
+
+	form := url.Values{}
+	form.Set("name", "leaky")
+	form.Set("interval", "60")
+	form.Set("description", "pinged from a public log")
+	ensureCode(t, serve(t, server, "POST", "/newtoken", form), http.StatusFound)
+
+	old, err := server.model.GetToken(1)
+	if err != nil {
+		t.Fatalf("getting token: %v", err)
+	}
+
+	recorder := serve(t, server, "POST", "/rotate/1", nil)
+	ensureCode(t, recorder, http.StatusFound)
+
+	rotated, err := server.model.GetToken(1)
+	if err != nil {
+		t.Fatalf("getting token: %v", err)
+	}
+	if rotated.Token == old.Token {
+		t.Fatalf("token string did not change after rotation")
+	}
+
+	// Both the old and the new token strings map to the token
+	for _, token := range []string{old.Token, rotated.Token} {
+		id, err := server.model.GetIdFromToken(token)
+		if err != nil {
+			t.Fatalf("getting id: %v", err)
+		}
+		ensureInt(t, id, 1)
+	}
+
+	// Once the overlap period is over, only the new token string works
+	_, err = server.model.RotateToken(1, 0)
+	if err != nil {
+		t.Fatalf("rotating token: %v", err)
+	}
+	id, err := server.model.GetIdFromToken(rotated.Token)
+	if err != nil {
+		t.Fatalf("getting id: %v", err)
+	}
+	ensureInt(t, id, 0)
+	id, err = server.model.GetIdFromToken(old.Token)
+	if err != nil {
+		t.Fatalf("getting id: %v", err)
+	}
+	ensureInt(t, id, 1)
+}
+
+func TestBackupEndpoint(t *testing.T) {
+	newServer := func(model Model, authenticated bool) *Server {
+		server, err := NewServer(ServerOpts{
+			model:          model,
+			logger:         log.Default(),
+			authMiddleware: noAuthMiddleware,
+			authenticated:  authenticated,
+		})
+		if err != nil {
+			t.Fatalf("Error creating server")
+		}
+		return server
+	}
+
+	// Without credentials anybody could download the database
+	recorder := serve(t, newServer(newSQLiteTestModel(t), false), "GET", "/admin/backup", nil)
+	ensureCode(t, recorder, http.StatusForbidden)
+
+	// The in-memory model has nothing to back up
+	recorder = serve(t, newServer(NewMemModel(), true), "GET", "/admin/backup", nil)
+	ensureCode(t, recorder, http.StatusNotImplemented)
+
+	server := newServer(newSQLiteTestModel(t), true)
+	recorder = serve(t, server, "GET", "/admin/backup?gzip=1", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	body := recorder.Body.Bytes()
+	if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		t.Fatalf("backup is not gzip compressed")
+	}
+	if !strings.Contains(recorder.Header().Get("Content-Disposition"), ".sqlite.gz") {
+		t.Fatalf("unexpected Content-Disposition %q", recorder.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	staging := newTestServer(t)
+	for _, tk := range []struct{ name, tags string }{
+		{"backup", "db"},
+		{"certs", ""},
+	} {
+		form := url.Values{}
+		form.Set("name", tk.name)
+		form.Set("interval", "60")
+		form.Set("description", tk.name+" job")
+		form.Set("tags", tk.tags)
+		ensureCode(t, serve(t, staging, "POST", "/newtoken", form), http.StatusFound)
+	}
+	ensureCode(t, serve(t, staging, "GET", "/enable/1", nil), http.StatusFound)
+	// backup depends on a token further down the export
+	mustSetDependency(t, staging.model, 1, 2)
+
+	for _, format := range []string{formatJSON, formatYAML} {
+		recorder := serve(t, staging, "GET", "/api/export?format="+format, nil)
+		ensureCode(t, recorder, http.StatusOK)
+		exported := recorder.Body.String()
+
+		prod := newTestServer(t)
+		result := importBody(t, prod, format, exported)
+		ensureInt(t, result.Created, 2)
+		result = importBody(t, prod, format, exported)
+		ensureInt(t, result.Created, 0)
+		ensureInt(t, result.Unchanged, 2)
+
+		// Both instances now export the same document
+		recorder = serve(t, prod, "GET", "/api/export?format="+format, nil)
+		ensureString(t, recorder.Body.String(), exported)
+		if !strings.Contains(exported, "depends_on") {
+			t.Fatalf("export does not have the dependency:\n%s", exported)
+		}
+	}
+
+	// Invalid documents are rejected before anything is written
+	prod := newTestServer(t)
+	r, err := http.NewRequest("POST", "http://localhost/api/import",
+		strings.NewReader(`{"tokens": [{"name": "x", "description": "y", "interval": 0, "token": "abc"}]}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	prod.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusBadRequest)
+}
+
+// importBody posts an export document to /api/import.
+func importBody(t *testing.T, server *Server, format, body string) ImportResult {
+	t.Helper()
+	r, err := http.NewRequest("POST", "http://localhost/api/import?format="+format, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusOK)
+
+	var result ImportResult
+	err = json.Unmarshal(recorder.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatalf("decoding import result: %v", err)
+	}
+	return result
+}
+
+func TestTokenAPI(t *testing.T) {
+	server := newTestServer(t)
+
+	body := `{"name": "backup", "description": "db backup", "interval": 60, "tags": ["DB", "db"]}`
+	r, err := http.NewRequest("POST", "http://localhost/api/tokens", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusCreated)
+	created := decodeAPIToken(t, recorder)
+	ensureString(t, created.Name, "backup")
+	ensureString(t, created.State, "disabled")
+	ensureInt(t, len(created.Tags), 1)
+
+	recorder = serve(t, server, "POST", apiTokenPath(created.ID)+"/enable", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	// Tokens stay fired until their first heartbeat
+	ensureString(t, decodeAPIToken(t, recorder).State, "fired")
+
+	recorder = serve(t, server, "GET", "/api/tokens?state=fired", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	var list []apiToken
+	err = json.Unmarshal(recorder.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatalf("decoding token list: %v", err)
+	}
+	ensureInt(t, len(list), 1)
+	ensureString(t, list[0].Token, created.Token)
+
+	recorder = serve(t, server, "GET", "/api/tokens?state=disabled", nil)
+	ensureString(t, strings.TrimSpace(recorder.Body.String()), "[]")
+
+	ensureCode(t, serve(t, server, "DELETE", apiTokenPath(created.ID), nil), http.StatusNoContent)
+	ensureCode(t, serve(t, server, "GET", apiTokenPath(created.ID), nil), http.StatusNotFound)
+
+	// Invalid tokens are rejected
+	r, err = http.NewRequest("POST", "http://localhost/api/tokens", strings.NewReader(`{"name": "x"}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusBadRequest)
+}
+
+func decodeAPIToken(t *testing.T, recorder *httptest.ResponseRecorder) apiToken {
+	t.Helper()
+	var tk apiToken
+	err := json.Unmarshal(recorder.Body.Bytes(), &tk)
+	if err != nil {
+		t.Fatalf("decoding token: %v", err)
+	}
+	return tk
+}
+
+func TestOrphanPings(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "removed job", "desc", 60)
+	ensureNoError(t, server.model.Remove(mustGetId(t, server.model, token)))
+
+	recorder := serve(t, server, "GET", "/hb/"+token, nil)
+	ensureCode(t, recorder, http.StatusOK)
+	ensureString(t, recorder.Body.String(), "ok t="+token+" (nd)")
+	ensureCode(t, serve(t, server, "GET", "/hb/<typo>", nil), http.StatusOK)
+
+	recorder = serve(t, server, "GET", "/orphans", nil)
+	ensureCode(t, recorder, http.StatusOK)
+	tokens := parseGeneric(t, recorder.Body.String(), "td", "orphan-token")
+	ensureInt(t, len(tokens), 2)
+	ensureString(t, tokens[0].Text, "<typo>")
+	ensureString(t, tokens[1].Text, token)
+	if !strings.Contains(recorder.Body.String(), "removed job") {
+		t.Fatalf("orphans page does not name the deleted token")
+	}
+
+	server, err := NewServer(ServerOpts{
+		model:          server.model,
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		orphanStatus:   http.StatusNotFound,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	ensureCode(t, serve(t, server, "GET", "/hb/"+token, nil), http.StatusNotFound)
+}
+
+func TestPingHistory(t *testing.T) {
+	server := newTestServer(t)
+	server.proxies, _ = parseTrustedProxies("127.0.0.1")
+	token := mustCreateToken(t, server.model, "backup", "db backup", 60)
+	id := mustGetId(t, server.model, token)
+
+	r := httptest.NewRequest("POST", "/hb/"+token+"?host=db1&run_id=42&exit_code=1", strings.NewReader("<disk full>"))
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("User-Agent", "kae-client")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, r)
+	ensureCode(t, recorder, http.StatusOK)
+
+	recorder = serve(t, server, "GET", "/history/"+strconv.Itoa(id), nil)
+	ensureCode(t, recorder, http.StatusOK)
+	body := recorder.Body.String()
+	for _, f := range []struct{ class, want string }{
+		{"ping-status", PingFail},
+		{"ping-from", "203.0.113.9"},
+		{"ping-host", "db1"},
+	} {
+		cells := parseGeneric(t, body, "td", f.class)
+		ensureInt(t, len(cells), 1)
+		ensureString(t, cells[0].Text, f.want)
+	}
+	if !strings.Contains(body, "&lt;disk full&gt;") || !strings.Contains(body, "POST kae-client") ||
+		!strings.Contains(body, "<td>1</td>") {
+		t.Fatalf("history is missing the output or client:\n%s", body)
+	}
+
+	ensureCode(t, serve(t, server, "GET", "/history/42", nil), http.StatusNotFound)
+}
+
+func TestHeartBeatBatch(t *testing.T) {
+	server := newTestServer(t)
+	a := mustCreateToken(t, server.model, "a", "desc", 60)
+	b := mustCreateToken(t, server.model, "b", "desc", 60)
+	batch := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/hb/batch", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	ts := time.Now().Add(-time.Minute).Unix()
+	recorder := batch(fmt.Sprintf(`[
+		{"token": %q, "status": "start", "ts": %d},
+		{"token": %q, "exit_code": 2, "output": "boom"},
+		{"token": "typo"},
+		{"token": %q, "host": "db1"}
+	]`, a, ts, a, b))
+	ensureCode(t, recorder, http.StatusOK)
+	var results []struct{ Token, Result string }
+	ensureNoError(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	ensureInt(t, len(results), 4)
+	for i, want := range []string{"recorded", "recorded", "unknown", "recorded"} {
+		ensureString(t, results[i].Result, want)
+	}
+
+	pings, err := server.model.GetPings(mustGetId(t, server.model, a), 10)
+	ensureNoError(t, err)
+	ensureInt(t, len(pings), 2)
+	ensureString(t, pings[0].Status, PingFail)
+	ensureString(t, pings[0].Output, "boom")
+	ensureInt(t, int(pings[1].Time.Unix()), int(ts))
+
+	// One bad ping rejects the whole batch
+	recorder = batch(fmt.Sprintf(`[{"token": %q}, {"token": %q, "status": "done"}]`, b, a))
+	ensureCode(t, recorder, http.StatusBadRequest)
+	if !strings.Contains(recorder.Body.String(), "ping 2") {
+		t.Fatalf("error does not name the bad ping: %s", recorder.Body.String())
+	}
+	ensureCode(t, batch(`[{"status": "ok"}]`), http.StatusBadRequest)
+	ensureCode(t, batch(`[]`), http.StatusBadRequest)
+	ensureCode(t, batch(`{`), http.StatusBadRequest)
+	pings, err = server.model.GetPings(mustGetId(t, server.model, b), 10)
+	ensureNoError(t, err)
+	ensureInt(t, len(pings), 1)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	ensureNoError(t, err)
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Only trusted proxies can set the address
+		{"192.0.2.1:1234", "203.0.113.9", "192.0.2.1"},
+		{"127.0.0.1:1234", "203.0.113.9", "203.0.113.9"},
+		// Addresses added by the client are skipped
+		{"127.0.0.1:1234", "198.51.100.7, 203.0.113.9, 10.1.2.3", "203.0.113.9"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/hb/x", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		ensureString(t, clientIP(r, trusted), tc.want)
+	}
+
+	_, err = parseTrustedProxies("localhost")
+	if err == nil {
+		t.Fatalf("expected an error parsing a hostname")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"host", 10, "host"},
+		{"hostname", 4, "host"},
+		// "é" is two bytes long and is not cut in half
+		{"café", 4, "caf"},
+		{"éé", 1, ""},
+	} {
+		ensureString(t, truncate(tc.s, tc.n), tc.want)
+	}
+}
+
+// newTestServer returns a server backed by a MemModel. The SQL models are
+// covered by the conformance suite in model_test.go.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		rotateOverlap:  time.Hour,
+		maxPingAge:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	return server
+}
+
 // getText recursively assembles the text nodes of n into a string.
 func getText(n *html.Node) string {
 	if n == nil {
@@ -216,6 +731,7 @@ func getAttr(n *html.Node, name string) string {
 
 type Form struct {
 	Action string
+	Method string
 	Inputs map[string]string
 	Label  string
 }
@@ -235,11 +751,11 @@ func parseForms(t *testing.T, htmlStr string) []Form {
 		if n.Type == html.ElementNode && n.Data == "form" {
 			action := getAttr(n, "action")
 			method := getAttr(n, "method")
-			if method != "POST" {
-				t.Fatalf("form %s method: got %s, want POST", action, method)
+			if method != "POST" && method != "GET" {
+				t.Fatalf("form %s method: got %s, want POST or GET", action, method)
 			}
 			enctype := getAttr(n, "enctype")
-			if enctype != "application/x-www-form-urlencoded" {
+			if method == "POST" && enctype != "application/x-www-form-urlencoded" {
 				t.Fatalf("form %s enctype: got %s, want application/x-www-form-urlencoded",
 					action, method)
 			}
@@ -257,6 +773,7 @@ func parseForms(t *testing.T, htmlStr string) []Form {
 
 			forms = append(forms, Form{
 				Action: action,
+				Method: method,
 				Inputs: inputs,
 				Label:  label,
 			})
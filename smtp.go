@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Largest email accepted by the SMTP listener.
+const maxMailSize = 1 << 20
+
+// newSMTPServer returns an SMTP server that turns mail sent to
+// {token}@domain into heartbeats, for devices that can only report by email.
+// The subject and body of the mail are kept as the output of the ping. A tag
+// in the address, as in {token}+fail@domain, sets the status of the ping.
+func (s *Server) newSMTPServer(addr, domain string) *smtp.Server {
+	srv := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		remote := c.Conn().RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		return &smtpSession{s: s, domain: domain, remoteAddr: remote, helo: c.Hostname()}, nil
+	}))
+	srv.Addr = addr
+	srv.Domain = domain
+	srv.MaxMessageBytes = maxMailSize
+	srv.MaxRecipients = 50
+	srv.ReadTimeout = time.Minute
+	srv.WriteTimeout = time.Minute
+	srv.ErrorLog = smtpLogger{s.logger}
+	return srv
+}
+
+// smtpLogger adapts our Logger to the one of the smtp package.
+type smtpLogger struct {
+	Logger
+}
+
+func (l smtpLogger) Println(v ...interface{}) {
+	l.Printf("smtp: %s", fmt.Sprintln(v...))
+}
+
+// smtpSession is a connection to the SMTP listener.
+type smtpSession struct {
+	s          *Server
+	domain     string
+	remoteAddr string
+	helo       string
+	rcpts      []smtpRcpt
+}
+
+// smtpRcpt is a recipient of the current mail: a token and the status of the
+// ping.
+type smtpRcpt struct {
+	token  string
+	status string
+}
+
+var errSMTPTryLater = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Try again later",
+}
+
+func (ss *smtpSession) Reset() {
+	ss.rcpts = nil
+}
+
+func (ss *smtpSession) Logout() error {
+	return nil
+}
+
+func (ss *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (ss *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	rcpt, err := parseSMTPRcpt(to, ss.domain)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      err.Error(),
+		}
+	}
+	ss.rcpts = append(ss.rcpts, rcpt)
+	return nil
+}
+
+// Data records a ping for every recipient. Like /hb/batch, they are all
+// admitted first and stored at once, so a mail is recorded for all its
+// recipients or for none. Rate limited recipients are skipped, and the mail
+// is only deferred when all of them were.
+func (ss *smtpSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	output := mailOutput(data)
+
+	var hbs []HeartBeat
+	var unknown []string
+	limited := false
+	for _, rcpt := range ss.rcpts {
+		p := Ping{
+			Time:       time.Now(),
+			Status:     rcpt.status,
+			Output:     output,
+			RemoteAddr: ss.remoteAddr,
+			Method:     "SMTP",
+			Host:       truncate(ss.helo, 255),
+		}
+		id, result, err := ss.s.admitHeartbeat(rcpt.token, p)
+		if err != nil {
+			ss.forget(hbs)
+			ss.s.logger.Printf("smtp: %v", err)
+			return errSMTPTryLater
+		}
+		switch result {
+		case hbRecorded:
+			hbs = append(hbs, HeartBeat{TokenID: id, Ping: p})
+		case hbLimitedByToken, hbLimitedByIP:
+			limited = true
+		case hbOrphan:
+			unknown = append(unknown, rcpt.token)
+		}
+	}
+
+	err = ss.s.model.InsertHeartBeats(hbs)
+	if err != nil {
+		ss.forget(hbs)
+		ss.s.logger.Printf("smtp: %v", err)
+		return errSMTPTryLater
+	}
+	ss.s.hbStats.recorded.Add(int64(len(hbs)))
+
+	if limited && len(hbs) == 0 && len(unknown) == 0 {
+		return errSMTPTryLater
+	}
+	if len(unknown) > 0 && ss.s.orphanStatus >= 400 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Unknown token " + strings.Join(unknown, ", "),
+		}
+	}
+	return nil
+}
+
+// forget tells the coalescer that the heartbeats were not stored after all.
+func (ss *smtpSession) forget(hbs []HeartBeat) {
+	for _, hb := range hbs {
+		ss.s.coalescer.forget(hb.TokenID)
+	}
+}
+
+// parseSMTPRcpt splits {token}[+status]@domain.
+func parseSMTPRcpt(to, domain string) (smtpRcpt, error) {
+	at := strings.LastIndex(to, "@")
+	if at < 0 || !strings.EqualFold(to[at+1:], domain) {
+		return smtpRcpt{}, fmt.Errorf("Only mail to {token}@%s is accepted", domain)
+	}
+	rcpt := smtpRcpt{token: to[:at], status: PingOK}
+	if plus := strings.LastIndex(rcpt.token, "+"); plus >= 0 {
+		rcpt.token, rcpt.status = rcpt.token[:plus], rcpt.token[plus+1:]
+	}
+	switch rcpt.status {
+	case PingOK, PingStart, PingFail:
+	default:
+		return smtpRcpt{}, fmt.Errorf("Invalid status %q, want ok, start or fail", rcpt.status)
+	}
+	if rcpt.token == "" {
+		return smtpRcpt{}, errors.New("Missing token")
+	}
+	return rcpt, nil
+}
+
+// mailOutput returns the subject and body of a mail, or the raw mail if it
+// cannot be parsed, cut to maxPingOutput.
+func mailOutput(data []byte) string {
+	out := data
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err == nil {
+		subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if err != nil {
+			subject = msg.Header.Get("Subject")
+		}
+		body, err := io.ReadAll(msg.Body)
+		if err == nil {
+			out = []byte("Subject: " + subject + "\n\n" + string(body))
+		}
+	}
+	return tail(string(out), maxPingOutput)
+}
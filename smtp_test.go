@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestSMTPHeartBeats(t *testing.T) {
+	server := newTestServer(t)
+	token := mustCreateToken(t, server.model, "ups", "ups self test", 86400)
+	id := mustGetId(t, server.model, token)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensureNoError(t, err)
+	srv := server.newSMTPServer(l.Addr().String(), "kae.local")
+	go srv.Serve(l)
+	defer srv.Close()
+
+	send := func(to, msg string) error {
+		return smtp.SendMail(l.Addr().String(), nil, "ups@example.com", []string{to}, []byte(msg))
+	}
+
+	err = send(token+"@KAE.local", "Subject: =?UTF-8?Q?Self_test_passed_=E2=9C=93?=\r\n\r\nBattery 100%\r\n")
+	ensureNoError(t, err)
+	last, err := server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingOK)
+	ensureString(t, last.Method, "SMTP")
+	ensureString(t, last.RemoteAddr, "127.0.0.1")
+	ensureString(t, last.Output, "Subject: Self test passed ✓\n\nBattery 100%\r\n")
+
+	ensureNoError(t, send(token+"+fail@kae.local", "Subject: Self test failed\r\n\r\n"))
+	last, err = server.model.LastPing(id)
+	ensureNoError(t, err)
+	ensureString(t, last.Status, PingFail)
+
+	// Mail to other domains or with bad statuses is refused
+	for _, to := range []string{token + "@example.com", token + "+done@kae.local"} {
+		err = send(to, "Subject: x\r\n\r\n")
+		if err == nil || !strings.Contains(err.Error(), "550") {
+			t.Fatalf("got err %v sending to %s, want a 550", err, to)
+		}
+	}
+
+	// Unknown tokens are orphans
+	ensureNoError(t, send("typo@kae.local", "Subject: x\r\n\r\n"))
+	orphans, err := server.model.GetOrphanPings(10)
+	ensureNoError(t, err)
+	ensureInt(t, len(orphans), 1)
+	ensureString(t, orphans[0].Token, "typo")
+}
+
+func TestSMTPRateLimits(t *testing.T) {
+	server, err := NewServer(ServerOpts{
+		model:          NewMemModel(),
+		logger:         log.Default(),
+		authMiddleware: noAuthMiddleware,
+		tokenRate:      1,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server")
+	}
+	ups := mustCreateToken(t, server.model, "ups", "ups self test", 86400)
+	nas := mustCreateToken(t, server.model, "nas", "nas self test", 86400)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensureNoError(t, err)
+	srv := server.newSMTPServer(l.Addr().String(), "kae.local")
+	go srv.Serve(l)
+	defer srv.Close()
+
+	send := func(to ...string) error {
+		return smtp.SendMail(l.Addr().String(), nil, "ups@example.com", to, []byte("Subject: x\r\n\r\n"))
+	}
+	pings := func(token string) int {
+		t.Helper()
+		list, err := server.model.GetPings(mustGetId(t, server.model, token), 10)
+		ensureNoError(t, err)
+		return len(list)
+	}
+
+	// The limited recipient is skipped and the others recorded
+	ensureNoError(t, send(ups+"@kae.local"))
+	ensureNoError(t, send(ups+"@kae.local", nas+"@kae.local"))
+	ensureInt(t, pings(ups), 1)
+	ensureInt(t, pings(nas), 1)
+
+	// With nothing recorded the mail is deferred
+	err = send(ups+"@kae.local", nas+"@kae.local")
+	if err == nil || !strings.Contains(err.Error(), "451") {
+		t.Fatalf("got err %v, want a 451", err)
+	}
+	ensureInt(t, pings(ups), 1)
+	ensureInt(t, pings(nas), 1)
+}
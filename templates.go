@@ -22,28 +22,69 @@ var homeTmpl = `<!DOCTYPE html>
    <input type="text" name="name" placeholder="name" autofocus> <br/>
    <input type="text" name="interval" placeholder="interval (secs)"> <br/>
    <input type="text" name="description" placeholder="description"> <br/>
+   <input type="text" name="tags" placeholder="tags (comma separated)"> <br/>
+   <select name="mode">
+    <option value="heartbeat">fire when heartbeats stop</option>
+    <option value="inverse">fire when a heartbeat arrives</option>
+    <option value="min_count">expect at least count heartbeats per interval</option>
+    <option value="max_count">expect at most count heartbeats per interval</option>
+   </select>
+   <input type="text" name="count" placeholder="count (min_count and max_count)"> <br/>
+   <input type="text" name="min_value" placeholder="fire when the value is below"> <br/>
+   <input type="text" name="max_deviation" placeholder="fire when the value deviates from the average by more than (%)"> <br/>
    <button>New Token</button>
   </form>
 
+  <form method="GET" action="/" class="filters">
+   <input type="search" name="q" placeholder="search" value="{{ .Filter.Search | html }}">
+   <input type="text" name="tag" placeholder="tag" value="{{ .Filter.Tag | html }}">
+   <select name="state">
+    <option value="">any state</option>
+    {{ range .States }}
+    <option value="{{ . }}" {{ if eq . $.Filter.State }}selected{{ end }}>{{ . }}</option>
+    {{ end }}
+   </select>
+   <select name="group">
+    <option value="">no grouping</option>
+    <option value="tag" {{ if eq .Filter.Group "tag" }}selected{{ end }}>group by tag</option>
+    <option value="state" {{ if eq .Filter.Group "state" }}selected{{ end }}>group by state</option>
+   </select>
+   <button>Filter</button>
+  </form>
+
   <input type="checkbox" id="reload" value="on"/> Reload every 5 secs.
 
+  {{ range .Groups }}
+  {{ if .Name }}<h3 class="group-name">{{ .Name | html }}</h3>{{ end }}
   <div class="grid">
   {{ range .Tokens }}
   <div class="entry" style="{{if .Disabled}} color: silver{{end}}">
     <div> 
       {{if not .Disabled}}
-        <span class="emoji">{{if .Fired}}🔥{{else}}🟢{{end}}</span>
+        <span class="emoji">{{if .Blocked}}⛔{{else if .Fired}}🔥{{else}}🟢{{end}}</span>
       {{end}}
       <span class="token-name">{{ .Name }}</span>
     </div>
    <div class="token-value">{{ .Token }}</div>
 
-   <div>({{.Interval}}s)</div>
+   <div>({{.Interval}}s{{ with .Rule.String }}, {{ . }}{{ end }})</div>
 
    <div>{{.Description}}</div>
 
+   {{ $blocked := .Blocked }}
+   {{ with index $.Names .DependsOn }}
+   <div class="depends-on">{{ if $blocked }}blocked by{{ else }}depends on{{ end }} {{ . | html }}</div>
+   {{ end }}
+
+   {{ if .Tags }}
+   <div class="tags">
+    {{ range .Tags }}<a href="/?tag={{ . | urlquery }}" class="tag">#{{ . | html }}</a> {{ end }}
+   </div>
+   {{ end }}
+
    <div>
     <a href="/delete/{{.ID}}" class="danger">delete</a> |
+    <a href="/edit/{{.ID}}">edit</a> |
     {{if .Disabled}}
     <a href="/enable/{{.ID}}">enable</a> 
     {{else}}
@@ -52,7 +93,154 @@ var homeTmpl = `<!DOCTYPE html>
     </div>
   </div>
   {{ end }}
-</div>
+  </div>
+  {{ end }}
+
+  <footer><a href="/orphans">orphan heartbeats</a></footer>
+
+ </body>
+</html>
+`
+
+var editTmpl = `<!DOCTYPE html>
+<html>
+ <head>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Keep an eye (edit)</title>
+  <link rel="icon" type="image/x-icon" href="/assets/favicon-32x32.png">
+  <link rel="stylesheet" href="/assets/pico.min.css">
+  <link rel="stylesheet" href="/assets/style.css">
+  </head>
+<body style="padding: 1rem">
+
+  <h1>Edit token</h1>
+
+  {{ if .Error }}
+    <p class="danger">{{ .Error | html }}</p>
+  {{ end }}
+
+  <form method="POST" action="/edit/{{ .ID }}" enctype="application/x-www-form-urlencoded">
+   <input type="text" name="name" placeholder="name" value="{{ .Form.Name | html }}" autofocus> <br/>
+   <input type="text" name="interval" placeholder="interval (secs)" value="{{ if .Form.Interval }}{{ .Form.Interval }}{{ end }}"> <br/>
+   <input type="text" name="description" placeholder="description" value="{{ .Form.Description | html }}"> <br/>
+   <input type="text" name="tags" placeholder="tags (comma separated)" value="{{ .Tags | html }}"> <br/>
+   <select name="mode">
+    <option value="heartbeat" {{ if eq .Form.Rule.Mode "heartbeat" }}selected{{ end }}>fire when heartbeats stop</option>
+    <option value="inverse" {{ if eq .Form.Rule.Mode "inverse" }}selected{{ end }}>fire when a heartbeat arrives</option>
+    <option value="min_count" {{ if eq .Form.Rule.Mode "min_count" }}selected{{ end }}>expect at least count heartbeats per interval</option>
+    <option value="max_count" {{ if eq .Form.Rule.Mode "max_count" }}selected{{ end }}>expect at most count heartbeats per interval</option>
+   </select>
+   <input type="text" name="count" placeholder="count (min_count and max_count)" value="{{ if .Form.Rule.Count }}{{ .Form.Rule.Count }}{{ end }}"> <br/>
+   <input type="text" name="min_value" placeholder="fire when the value is below" value="{{ .Form.Rule.MinValueText }}"> <br/>
+   <input type="text" name="max_deviation" placeholder="fire when the value deviates from the average by more than (%)" value="{{ if .Form.Rule.MaxDeviation }}{{ .Form.Rule.MaxDeviation }}{{ end }}"> <br/>
+   <select name="depends_on">
+    <option value="">depends on no other token</option>
+    {{ range .Others }}
+    <option value="{{ .ID }}" {{ if eq .ID $.Form.DependsOn }}selected{{ end }}>depends on {{ .Name | html }}</option>
+    {{ end }}
+   </select> <br/>
+   <button>Save</button>
+  </form>
+
+  <form method="POST" action="/rotate/{{ .ID }}" enctype="application/x-www-form-urlencoded">
+   <label>Issue a new token string. The current one keeps working for {{ .RotateOverlap }}.</label>
+   <button class="secondary">Rotate secret</button>
+  </form>
+
+  <a href="/history/{{ .ID }}">history</a> |
+  <a href="/">back</a>
+
+ </body>
+</html>
+`
+
+var orphansTmpl = `<!DOCTYPE html>
+<html>
+ <head>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Keep an eye (orphan heartbeats)</title>
+  <link rel="icon" type="image/x-icon" href="/assets/favicon-32x32.png">
+  <link rel="stylesheet" href="/assets/pico.min.css">
+  <link rel="stylesheet" href="/assets/style.css">
+  </head>
+<body style="padding: 1rem">
+
+  <h1>Orphan heartbeats</h1>
+
+  <p>Heartbeats for token strings that match no token: typos, or jobs still pinging deleted tokens.</p>
+
+  {{ if .Pings }}
+  <table>
+   <thead>
+    <tr><th>time</th><th>token</th><th>deleted token</th><th>from</th><th>user agent</th></tr>
+   </thead>
+   <tbody>
+   {{ range .Pings }}
+    <tr class="orphan">
+     <td>{{ .Time.Format "2006-01-02 15:04:05" }}</td>
+     <td class="orphan-token">{{ .Token | html }}</td>
+     <td>{{ .DeletedName | html }}</td>
+     <td>{{ .RemoteAddr | html }}</td>
+     <td>{{ .UserAgent | html }}</td>
+    </tr>
+   {{ end }}
+   </tbody>
+  </table>
+  {{ else }}
+  <p>None so far.</p>
+  {{ end }}
+
+  <a href="/">back</a>
+
+ </body>
+</html>
+`
+
+var historyTmpl = `<!DOCTYPE html>
+<html>
+ <head>
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Keep an eye (history)</title>
+  <link rel="icon" type="image/x-icon" href="/assets/favicon-32x32.png">
+  <link rel="stylesheet" href="/assets/pico.min.css">
+  <link rel="stylesheet" href="/assets/style.css">
+  </head>
+<body style="padding: 1rem">
+
+  <h1>{{ .Token.Name | html }}</h1>
+
+  <p>Last {{ .Limit }} heartbeats, most recent first.</p>
+
+  {{ if .Pings }}
+  <table>
+   <thead>
+    <tr><th>time</th><th>status</th><th>exit code</th><th>duration</th><th>value</th><th>from</th><th>host</th><th>run</th><th>client</th></tr>
+   </thead>
+   <tbody>
+   {{ range .Pings }}
+    <tr class="ping">
+     <td>{{ .Time.Format "2006-01-02 15:04:05" }}</td>
+     <td class="ping-status">{{ .Status }}</td>
+     <td>{{ if .ExitCode }}{{ .ExitCode }}{{ end }}</td>
+     <td>{{ if .Duration }}{{ .Duration }}{{ end }}</td>
+     <td class="ping-value">{{ .ValueText | html }}</td>
+     <td class="ping-from">{{ .RemoteAddr | html }}</td>
+     <td class="ping-host">{{ .Host | html }}</td>
+     <td>{{ .RunID | html }}</td>
+     <td>{{ .Method }} {{ .UserAgent | html }}</td>
+    </tr>
+    {{ if .Output }}
+    <tr><td colspan="9"><details><summary>output</summary><pre>{{ .Output | html }}</pre></details></td></tr>
+    {{ end }}
+   {{ end }}
+   </tbody>
+  </table>
+  {{ else }}
+  <p>No heartbeats yet.</p>
+  {{ end }}
+
+  <a href="/edit/{{ .Token.ID }}">edit</a> |
+  <a href="/">back</a>
 
  </body>
 </html>
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Defaults for the token strings used in /hb/{token}. 20 characters out of 21
+// letters give ~87 bits of entropy.
+const (
+	defaultTokenLength   = 20
+	defaultTokenAlphabet = "bcdfghjklmnpqrstvwxyz"
+)
+
+// Limits of the token strings: they are the only secret needed to send
+// heartbeats, and are stored in VARCHAR(255) columns.
+const (
+	minTokenBits   = 64
+	maxTokenLength = 255
+)
+
+// Characters that can be used in a URL path segment without escaping.
+const urlSafeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.~"
+
+// TokenGenerator creates random token strings using crypto/rand.
+type TokenGenerator struct {
+	Length   int
+	Alphabet string
+}
+
+var defaultTokenGenerator = TokenGenerator{
+	Length:   defaultTokenLength,
+	Alphabet: defaultTokenAlphabet,
+}
+
+// Validate checks the generator can produce usable token strings.
+func (g TokenGenerator) Validate() error {
+	err := g.validateAlphabet()
+	if err != nil {
+		return err
+	}
+	return g.validateLength()
+}
+
+// validateLength checks the length fits the database and, with a valid
+// alphabet, gives token strings hard enough to guess.
+func (g TokenGenerator) validateLength() error {
+	if g.Length <= 0 || g.Length > maxTokenLength {
+		return fmt.Errorf("token length must be between 1 and %d, got %d", maxTokenLength, g.Length)
+	}
+	if g.validateAlphabet() != nil {
+		return nil
+	}
+	bits := float64(g.Length) * math.Log2(float64(len(g.Alphabet)))
+	if bits < minTokenBits {
+		return fmt.Errorf("%d characters out of %d give %.0f bits of entropy, at least %d are needed",
+			g.Length, len(g.Alphabet), bits, minTokenBits)
+	}
+	return nil
+}
+
+func (g TokenGenerator) validateAlphabet() error {
+	seen := map[rune]bool{}
+	for _, c := range g.Alphabet {
+		if !strings.ContainsRune(urlSafeChars, c) {
+			return fmt.Errorf("token alphabet contains %q which is not URL safe", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("token alphabet contains %q more than once", c)
+		}
+		seen[c] = true
+	}
+	if len(seen) < 2 {
+		return errors.New("token alphabet needs at least two characters")
+	}
+	return nil
+}
+
+// Generate returns a new random token string.
+func (g TokenGenerator) Generate() (string, error) {
+	max := big.NewInt(int64(len(g.Alphabet)))
+	id := make([]byte, g.Length)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		id[i] = g.Alphabet[n.Int64()]
+	}
+	return string(id), nil
+}